@@ -0,0 +1,170 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/statequery"
+	"net/http"
+	"net/url"
+)
+
+// Type for Slack interactive component callbacks
+type slackInteraction struct {
+	Type string `json:"type"`
+	User struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	Actions []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+	ResponseURL string `json:"response_url"`
+	Message     struct {
+		Text   string            `json:"text"`
+		Blocks []json.RawMessage `json:"blocks"`
+	} `json:"message"`
+}
+
+// Settings of the actions offered on alert messages
+func (cfg *config) actions() *statequery.AlertActions {
+	return &statequery.AlertActions{
+		SnoozeFor:  cfg.snoozeFor,
+		ScaleSlots: cfg.scaleSlots,
+	}
+}
+
+// Perform an action on the alert of a reservation, returning a note on the outcome.
+// User names the actor in notes, while principal is the stable identity checked
+// against SCALE_UP_USERS: the email on Google Chat and the user ID on Slack.
+func (srv *server) act(ctx context.Context, action string, id string, user string, principal string) (string, error) {
+	switch action {
+	case statequery.ActionAcknowledge:
+		err := srv.incidents.Acknowledge(ctx, id, user)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s acknowledged by %s", id, user), nil
+
+	case statequery.ActionSnooze:
+		if srv.silences == nil {
+			return "", fmt.Errorf("silences unavailable, STATE_BUCKET not configured")
+		}
+		request := silenceRequest{
+			Match:    statequery.Matcher{Reservation: id},
+			Duration: statequery.Duration{Duration: srv.cfg.snoozeFor},
+			Comment:  "snoozed from alert message",
+		}
+		silence, err := request.silence(user)
+		if err != nil {
+			return "", err
+		}
+		silence, err = srv.silences.Add(ctx, silence)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s snoozed by %s until %s", id, user, silence.EndsAt.Format("15:04 MST")), nil
+
+	case statequery.ActionScaleUp:
+		if srv.cfg.scaleSlots <= 0 {
+			return "", fmt.Errorf("scaling up is disabled")
+		}
+		if !srv.cfg.scaleUsers[principal] {
+			log.Printf("refused scaling up %s by %s (%s), not listed in SCALE_UP_USERS\n", id, user, principal)
+			return "", fmt.Errorf("%s is not allowed to scale reservations", user)
+		}
+		log.Printf("scaling up %s by %d slots on behalf of %s (%s)\n", id, srv.cfg.scaleSlots, user, principal)
+		capacity, err := statequery.ScaleReservation(ctx, srv.cfg.adminProject(), id, srv.cfg.scaleSlots, srv.cfg.scaleMaxSlots)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("scaled up %s from %d to %d slots on behalf of %s (%s)\n", id, capacity-srv.cfg.scaleSlots, capacity, user, principal)
+		return fmt.Sprintf("%d slots added to %s by %s, now %d slots", srv.cfg.scaleSlots, id, user, capacity), nil
+
+	default:
+		return "", fmt.Errorf("unknown action: %s", action)
+	}
+}
+
+// POST /slack/actions: handle buttons on Slack alert messages and edit the original
+// message to show who acted
+func (srv *server) handleSlackActions(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	body, err := srv.verifySlack(req)
+	if err != nil {
+		log.Printf("rejected slack request: %v\n", err)
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	interaction := slackInteraction{}
+	err = json.Unmarshal([]byte(form.Get("payload")), &interaction)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Acknowledge right away, actions may take longer than Slack waits
+	w.WriteHeader(http.StatusOK)
+	if interaction.Type != "block_actions" || len(interaction.Actions) == 0 {
+		return
+	}
+
+	user := fmt.Sprintf("slack:%s", interaction.User.Username)
+	principal := fmt.Sprintf("slack:%s", interaction.User.ID)
+	action := interaction.Actions[0]
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+
+		log.Printf("slack action %s on %s by %s (%s)\n", action.ActionID, action.Value, user, principal)
+		note, err := srv.act(ctx, action.ActionID, action.Value, user, principal)
+		if err != nil {
+			log.Printf("failed slack action %s on %s: %v\n", action.ActionID, action.Value, err)
+			note = fmt.Sprintf("Failed to %s %s: %v", action.ActionID, action.Value, err)
+		}
+
+		// Keep the original message and note the outcome below it
+		outcome := map[string]interface{}{
+			"type":     "context",
+			"elements": []interface{}{map[string]string{"type": "mrkdwn", "text": note}},
+		}
+		blocks := []interface{}{}
+		for _, block := range interaction.Message.Blocks {
+			blocks = append(blocks, block)
+		}
+		blocks = append(blocks, outcome)
+		err = statequery.PostJSON(ctx, interaction.ResponseURL, map[string]interface{}{
+			"replace_original": true,
+			"text":             interaction.Message.Text,
+			"blocks":           blocks,
+		})
+		if err != nil {
+			log.Printf("failed to update slack message: %v\n", err)
+		}
+	}()
+}
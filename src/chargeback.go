@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"main/statequery"
+	"net/http"
+	"time"
+)
+
+// Type for responses of the chargeback endpoint
+type chargebackResponse struct {
+	*statequery.Chargeback
+	Objects []string `json:"objects"`
+	Table   string   `json:"table,omitempty"`
+}
+
+// POST /chargeback?date=YYYY-MM-DD: integrate the slot-hours of a day (UTC,
+// defaulting to yesterday) from the archived states, and export them to the state
+// bucket and, if configured, to BigQuery. Responds with status 500 if an export
+// failed, so schedulers retry.
+func (srv *server) handleChargeback(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	date := today.Add(-24 * time.Hour)
+	if value := req.URL.Query().Get("date"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid date, expected YYYY-MM-DD: %s", value))
+			return
+		}
+		if parsed.After(today) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("date is in the future: %s", value))
+			return
+		}
+		date = parsed
+	}
+
+	// Charge projects to their parent folder or organization
+	chargeback, err := statequery.BuildChargeback(req.Context(), srv.cfg.bucket, date, srv.cfg.chargebackLabel, srv.resolver)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no history available: %v", err))
+		return
+	}
+	log.Printf("built chargeback of %s with %d rows\n", chargeback.Date, len(chargeback.Rows))
+
+	err = chargeback.Export(req.Context(), srv.cfg.bucket)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to export chargeback: %v", err))
+		return
+	}
+	if srv.cfg.chargebackTable != "" {
+		err = chargeback.LoadTable(req.Context(), srv.cfg.bucket, srv.cfg.chargebackTable)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to load chargeback: %v", err))
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, chargebackResponse{
+		Chargeback: chargeback,
+		Objects:    chargeback.Objects(),
+		Table:      srv.cfg.chargebackTable,
+	})
+}
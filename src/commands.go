@@ -0,0 +1,232 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"main/statequery"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deadline for answering commands asynchronously, e.g. after a scan
+const commandTimeout = 5 * time.Minute
+
+// Number of jobs and projects listed by the 'top' command
+const topJobs = 10
+
+// Type for replies to commands
+type commandReply struct {
+	Text   string
+	Public bool
+}
+
+// Usage of the commands, invoked through the given prefix, e.g. a slash command
+func commandUsage(prefix string) string {
+	return "Usage:\n" +
+		fmt.Sprintf("`%s [reservation|location]` show the utilization of all or matching reservations\n", prefix) +
+		fmt.Sprintf("`%s status [reservation|location]` same as above\n", prefix) +
+		fmt.Sprintf("`%s refresh [reservation|location]` scan now instead of showing the last state\n", prefix) +
+		fmt.Sprintf("`%s top [reservation|location]` show the top jobs and projects\n", prefix) +
+		fmt.Sprintf("`%s silence <reservation> <duration> [comment]` silence alerts, e.g. `silence US.etl 2h backfill`", prefix)
+}
+
+// Run a command given as text of a Slack slash command, or a mention of the Slack
+// or Google Chat app. Usage is shown for help and invalid commands.
+func (srv *server) command(ctx context.Context, text string, user string, usage string) commandReply {
+	fields := strings.Fields(text)
+	command := ""
+	if len(fields) > 0 {
+		command = fields[0]
+	}
+
+	switch command {
+	case "help":
+		return commandReply{Text: usage}
+
+	case "silence":
+		return srv.silenceCommand(ctx, fields[1:], user, usage)
+
+	case "refresh":
+		// Chat users may not cancel jobs, but the refreshed state is kept like others
+		srv.scanMutex.Lock()
+		state, err := srv.scan(ctx, false)
+		if err == nil {
+			srv.remember(state)
+			err := state.DumpState(ctx, srv.cfg.bucket)
+			if err != nil {
+				log.Printf("failed to dump state: %v\n", err)
+			}
+		}
+		srv.scanMutex.Unlock()
+		if err != nil {
+			return commandReply{Text: fmt.Sprintf("Scan failed: %v", err)}
+		}
+		return srv.reportCommand(state, strings.Join(fields[1:], " "), usage)
+
+	case "top":
+		state, err := srv.current(ctx)
+		if err != nil {
+			return commandReply{Text: fmt.Sprintf("No state available: %v", err)}
+		}
+		return topCommand(state, strings.Join(fields[1:], " "), usage)
+
+	case "status":
+		state, err := srv.current(ctx)
+		if err != nil {
+			return commandReply{Text: fmt.Sprintf("No state available: %v", err)}
+		}
+		return srv.reportCommand(state, strings.Join(fields[1:], " "), usage)
+
+	default:
+		state, err := srv.current(ctx)
+		if err != nil {
+			return commandReply{Text: fmt.Sprintf("No state available: %v", err)}
+		}
+		return srv.reportCommand(state, strings.Join(fields, " "), usage)
+	}
+}
+
+// Reply with the rendered report of matching reservations
+func (srv *server) reportCommand(state *statequery.State, query string, usage string) commandReply {
+	filtered := filterReservations(state, query)
+	if len(filtered.Reservations) == 0 {
+		return commandReply{Text: fmt.Sprintf("No reservations matching '%s'.\n%s", query, usage)}
+	}
+
+	message, err := srv.templates.Firing(filtered)
+	if err != nil {
+		return commandReply{Text: fmt.Sprintf("Failed to render report: %v", err)}
+	}
+	return commandReply{
+		Text:   fmt.Sprintf("%s\n_As of %s_", message, state.Timestamp.Format("2006-01-02 15:04 MST")),
+		Public: true,
+	}
+}
+
+// Reply with the jobs and projects using the most slots in matching reservations
+func topCommand(state *statequery.State, query string, usage string) commandReply {
+	filtered := filterReservations(state, query)
+	if len(filtered.Reservations) == 0 {
+		return commandReply{Text: fmt.Sprintf("No reservations matching '%s'.\n%s", query, usage)}
+	}
+
+	var jobs []statequery.Job
+	projects := make(map[string]float64)
+	for _, reservation := range filtered.Reservations {
+		jobs = append(jobs, reservation.Jobs...)
+		for _, project := range reservation.TopProjects(len(reservation.Jobs)) {
+			projects[project.Project] += project.Usage
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Usage > jobs[j].Usage
+	})
+	if len(jobs) > topJobs {
+		jobs = jobs[:topJobs]
+	}
+
+	var text bytes.Buffer
+	text.WriteString("Top jobs:\n```\n")
+	for _, job := range jobs {
+		fmt.Fprintf(&text, "%6.0f slots  %s (%s)\n", job.Usage, job.Name, job.User)
+	}
+	if len(jobs) == 0 {
+		text.WriteString("no running jobs\n")
+	}
+	text.WriteString("```\nTop projects:\n```\n")
+	for _, project := range sortProjects(projects, topJobs) {
+		fmt.Fprintf(&text, "%6.0f slots  %s\n", project.Usage, project.Project)
+	}
+	if len(projects) == 0 {
+		text.WriteString("no running jobs\n")
+	}
+	text.WriteString("```")
+	return commandReply{Text: text.String(), Public: true}
+}
+
+// Create a silence from the arguments '<reservation> <duration> [comment]'
+func (srv *server) silenceCommand(ctx context.Context, args []string, user string, usage string) commandReply {
+	if srv.silences == nil {
+		return commandReply{Text: "Silences are unavailable, STATE_BUCKET is not configured."}
+	}
+	if len(args) < 2 {
+		return commandReply{Text: usage}
+	}
+
+	duration, err := time.ParseDuration(args[1])
+	if err != nil {
+		return commandReply{Text: fmt.Sprintf("Invalid duration '%s', use e.g. 30m or 2h.", args[1])}
+	}
+	comment := strings.Join(args[2:], " ")
+	if comment == "" {
+		comment = fmt.Sprintf("silenced by %s", user)
+	}
+
+	request := silenceRequest{
+		Match:    statequery.Matcher{Reservation: args[0]},
+		Duration: statequery.Duration{Duration: duration},
+		Comment:  comment,
+	}
+	silence, err := request.silence(user)
+	if err != nil {
+		return commandReply{Text: fmt.Sprintf("Invalid silence: %v", err)}
+	}
+	silence, err = srv.silences.Add(ctx, silence)
+	if err != nil {
+		return commandReply{Text: fmt.Sprintf("Failed to create silence: %v", err)}
+	}
+	log.Printf("created silence %s by %s: %s\n", silence.ID, silence.CreatedBy, silence.Comment)
+	return commandReply{
+		Text:   fmt.Sprintf("Silenced %s until %s (%s): %s", args[0], silence.EndsAt.Format("2006-01-02 15:04 MST"), silence.ID, comment),
+		Public: true,
+	}
+}
+
+// Copy of the state holding only reservations matching the query by ID, name or
+// location. An empty query matches all reservations.
+func filterReservations(state *statequery.State, query string) *statequery.State {
+	filtered := &statequery.State{
+		Timestamp:    state.Timestamp,
+		Reservations: make(map[string]statequery.Reservation),
+	}
+	for id, reservation := range state.Reservations {
+		byReservation := statequery.Matcher{Reservation: query}
+		byLocation := statequery.Matcher{Location: query}
+		if query == "" || byReservation.Matches(id, reservation) || byLocation.Matches(id, reservation) {
+			filtered.Reservations[id] = reservation
+		}
+	}
+	return filtered
+}
+
+// Sort projects by usage, keeping at most n
+func sortProjects(usage map[string]float64, n int) []statequery.ProjectUsage {
+	var projects []statequery.ProjectUsage
+	for project, slots := range usage {
+		projects = append(projects, statequery.ProjectUsage{Project: project, Usage: slots})
+	}
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].Usage > projects[j].Usage
+	})
+	if len(projects) > n {
+		projects = projects[:n]
+	}
+	return projects
+}
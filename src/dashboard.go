@@ -0,0 +1,87 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"main/statequery"
+	"net/http"
+	"time"
+)
+
+// Static dashboard assets, compiled into the binary
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// Longest history window served to the dashboard
+const maxHistoryWindow = 31 * 24 * time.Hour
+
+// Type for history responses
+type historyResponse struct {
+	Threshold float64                   `json:"threshold"`
+	Points    []statequery.HistoryPoint `json:"points"`
+}
+
+// Serve the dashboard assets under /dashboard/
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(files)))
+}
+
+// GET /history?window=24h: return the utilization time series from archived states
+func (srv *server) handleHistory(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	window, err := parseWindow(req.URL.Query().Get("window"), 24*time.Hour)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	history, err := statequery.LoadHistory(req.Context(), srv.cfg.bucket, time.Now().UTC().Add(-window))
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no history available: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, historyResponse{
+		Threshold: srv.cfg.threshold,
+		Points:    statequery.Series(history),
+	})
+}
+
+// Parse a history window from a query parameter, applying a default and upper bound
+func parseWindow(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("invalid window: %s", value)
+	}
+	if window > maxHistoryWindow {
+		window = maxHistoryWindow
+	}
+	return window, nil
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2021 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Dashboard for current and historical reservation utilization.
+// Uses plain DOM and SVG only, so no external scripts need to be loaded.
+
+const SVG = "http://www.w3.org/2000/svg";
+const COLORS = ["#1a73e8", "#d93025", "#188038", "#f9ab00", "#9334e6", "#e8710a", "#12b5cb", "#5f6368"];
+const REFRESH_MILLIS = 60 * 1000;
+
+// Create an element with attributes and optional text content
+function element(tag, attributes = {}, text = null, namespace = null) {
+  const node = namespace ? document.createElementNS(namespace, tag) : document.createElement(tag);
+  for (const [key, value] of Object.entries(attributes)) {
+    node.setAttribute(key, value);
+  }
+  if (text !== null) {
+    node.textContent = text;
+  }
+  return node;
+}
+
+// Fetch JSON from a service endpoint relative to the dashboard. With in-app
+// authentication, requests carry the identity token added by the proxy.
+async function load(path) {
+  const response = await fetch(path, { credentials: "same-origin" });
+  if (response.status === 401) {
+    throw new Error("Not authenticated, open the dashboard through a proxy adding identity tokens");
+  }
+  const body = await response.json();
+  if (!response.ok) {
+    throw new Error(body.error || response.statusText);
+  }
+  return body;
+}
+
+// Utilization factor of a reservation, also for states without the factor
+function utilization(reservation) {
+  if (reservation.utilization) {
+    return reservation.utilization;
+  }
+  const capacity = reservation.slots || reservation.autoscale_max_slots || 0;
+  return capacity > 0 ? reservation.total_usage / capacity : 0;
+}
+
+// Point on the gauge arc for a utilization factor
+function arcPoint(factor, radius) {
+  const angle = Math.PI * (1 - Math.min(factor, 1));
+  return [60 + radius * Math.cos(angle), 60 - radius * Math.sin(angle)];
+}
+
+// Semicircle gauge for a utilization factor
+function gauge(factor, breached) {
+  const svg = element("svg", { class: "gauge", width: 120, height: 70, viewBox: "0 0 120 70" }, null, SVG);
+  const [endX, endY] = arcPoint(factor, 50);
+  svg.appendChild(element("path", {
+    d: "M 10 60 A 50 50 0 0 1 110 60", fill: "none", stroke: "#e8eaed", "stroke-width": 10,
+  }, null, SVG));
+  if (factor > 0) {
+    svg.appendChild(element("path", {
+      d: `M 10 60 A 50 50 0 0 1 ${endX.toFixed(2)} ${endY.toFixed(2)}`,
+      fill: "none", stroke: breached ? "#d93025" : "#1a73e8", "stroke-width": 10,
+    }, null, SVG));
+  }
+  svg.appendChild(element("text", { x: 60, y: 58 }, `${(factor * 100).toFixed(1)}%`, SVG));
+  return svg;
+}
+
+// Table of the top entries of a usage map
+function topTable(title, usage, limit = 5) {
+  const fragment = document.createDocumentFragment();
+  const entries = Object.entries(usage).sort((a, b) => b[1] - a[1]).slice(0, limit);
+  if (entries.length === 0) {
+    return fragment;
+  }
+  fragment.appendChild(element("h4", {}, title));
+  const table = element("table");
+  for (const [name, slots] of entries) {
+    const row = element("tr");
+    row.appendChild(element("td", {}, name));
+    row.appendChild(element("td", { class: "usage" }, `${slots.toFixed(1)} slots`));
+    table.appendChild(row);
+  }
+  fragment.appendChild(table);
+  return fragment;
+}
+
+// Card per reservation with gauge, top projects and top jobs
+function renderReservations(state) {
+  const container = document.getElementById("reservations");
+  container.replaceChildren();
+
+  const ids = Object.keys(state.reservations || {}).sort();
+  for (const id of ids) {
+    const reservation = state.reservations[id];
+    const factor = utilization(reservation);
+    const card = element("div", { class: reservation.threshold_breached ? "card breached" : "card" });
+    card.appendChild(element("h3", {}, id));
+    card.appendChild(gauge(factor, reservation.threshold_breached));
+    card.appendChild(element("div", { class: "summary" },
+      `${reservation.total_usage_ceiling || 0} / ${reservation.slots} slots, ${reservation.num_jobs || 0} jobs`));
+    if (reservation.suppressed) {
+      card.appendChild(element("div", { class: "suppressed" }, `Suppressed by ${reservation.suppressed_by}`));
+    }
+
+    const projects = {};
+    const jobs = {};
+    for (const job of reservation.jobs || []) {
+      const project = job.project || job.name.split(":")[0];
+      projects[project] = (projects[project] || 0) + job.usage;
+      jobs[job.name] = job.usage;
+    }
+    card.appendChild(topTable("Top projects", projects));
+    card.appendChild(topTable("Top jobs", jobs));
+    container.appendChild(card);
+  }
+
+  if (state.timestamp) {
+    document.getElementById("updated").textContent = `Updated ${new Date(state.timestamp).toLocaleString()}`;
+  }
+}
+
+// Line chart of utilization per reservation, with the alerting threshold
+function renderChart(history) {
+  const chart = document.getElementById("chart");
+  const legend = document.getElementById("legend");
+  chart.replaceChildren();
+  legend.replaceChildren();
+
+  const points = history.points || [];
+  if (points.length === 0) {
+    chart.appendChild(element("p", { class: "summary" }, "No history available"));
+    return;
+  }
+
+  const width = Math.max(chart.clientWidth, 600);
+  const height = 300;
+  const margin = { top: 10, right: 10, bottom: 24, left: 40 };
+  const plotWidth = width - margin.left - margin.right;
+  const plotHeight = height - margin.top - margin.bottom;
+
+  const times = points.map((point) => new Date(point.timestamp).getTime());
+  const start = times[0];
+  const end = Math.max(times[times.length - 1], start + 1);
+  let maximum = Math.max(1, history.threshold || 0);
+  for (const point of points) {
+    for (const factor of Object.values(point.utilization)) {
+      maximum = Math.max(maximum, factor);
+    }
+  }
+
+  const x = (time) => margin.left + ((time - start) / (end - start)) * plotWidth;
+  const y = (factor) => margin.top + plotHeight - (factor / maximum) * plotHeight;
+
+  const svg = element("svg", { width: "100%", height, viewBox: `0 0 ${width} ${height}` }, null, SVG);
+
+  // Horizontal grid lines in steps of 25%
+  for (let factor = 0; factor <= maximum + 1e-9; factor += 0.25) {
+    svg.appendChild(element("line", {
+      x1: margin.left, x2: width - margin.right, y1: y(factor), y2: y(factor), stroke: "#f1f3f4",
+    }, null, SVG));
+    svg.appendChild(element("text", { x: 4, y: y(factor) + 4 }, `${Math.round(factor * 100)}%`, SVG));
+  }
+
+  // Time labels at both ends
+  svg.appendChild(element("text", { x: margin.left, y: height - 6 }, new Date(start).toLocaleString(), SVG));
+  svg.appendChild(element("text", { x: width - margin.right, y: height - 6, "text-anchor": "end" },
+    new Date(end).toLocaleString(), SVG));
+
+  // Alerting threshold
+  if (history.threshold) {
+    svg.appendChild(element("line", {
+      x1: margin.left, x2: width - margin.right, y1: y(history.threshold), y2: y(history.threshold),
+      stroke: "#d93025", "stroke-dasharray": "4 4",
+    }, null, SVG));
+  }
+
+  // One line per reservation
+  const ids = [...new Set(points.flatMap((point) => Object.keys(point.utilization)))].sort();
+  ids.forEach((id, index) => {
+    const color = COLORS[index % COLORS.length];
+    const coordinates = [];
+    points.forEach((point, i) => {
+      if (id in point.utilization) {
+        coordinates.push(`${x(times[i]).toFixed(1)},${y(point.utilization[id]).toFixed(1)}`);
+      }
+    });
+    svg.appendChild(element("polyline", {
+      points: coordinates.join(" "), fill: "none", stroke: color, "stroke-width": 2,
+    }, null, SVG));
+    const entry = element("span", { style: `--color: ${color}` }, id);
+    legend.appendChild(entry);
+  });
+
+  chart.appendChild(svg);
+}
+
+// Show or clear an error message
+function showError(error) {
+  const node = document.getElementById("error");
+  node.hidden = !error;
+  node.textContent = error ? error.message : "";
+}
+
+// Reload current state and history
+async function refresh() {
+  const window = document.getElementById("window").value;
+  try {
+    const [state, history] = await Promise.all([
+      load("../status"),
+      load(`../history?window=${encodeURIComponent(window)}`),
+    ]);
+    renderReservations(state);
+    renderChart(history);
+    showError(null);
+  } catch (error) {
+    showError(error);
+  }
+}
+
+document.getElementById("window").addEventListener("change", refresh);
+refresh();
+setInterval(refresh, REFRESH_MILLIS);
@@ -0,0 +1,113 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"main/statequery"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Length of digest periods
+var digestPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// Type for responses of the digest endpoint
+type digestResponse struct {
+	*statequery.Digest
+	Deliveries []statequery.Delivery `json:"deliveries"`
+}
+
+// POST /digest?period=daily|weekly: summarize the utilization of the period up to
+// now from the archived states, and post it to the digest notifiers. Responds with
+// status 500 if any notifier failed, so schedulers retry.
+func (srv *server) handleDigest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	period := req.URL.Query().Get("period")
+	if period == "" {
+		period = "daily"
+	}
+	length, ok := digestPeriods[period]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid period, expected daily or weekly: %s", period))
+		return
+	}
+
+	to := time.Now().UTC()
+	digest, err := statequery.BuildDigest(req.Context(), srv.cfg.bucket, period, to.Add(-length), to, srv.cfg.threshold)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no history available: %v", err))
+		return
+	}
+	log.Printf("built %s digest of %d reservations\n", period, len(digest.Reservations))
+
+	deliveries, err := srv.notifyReport(req.Context(), digest, srv.cfg.digestNotifiers)
+	response := digestResponse{Digest: digest, Deliveries: deliveries}
+	if err != nil {
+		log.Printf("%v\n", err)
+		writeJSON(w, http.StatusInternalServerError, response)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Post a report to the given notifiers concurrently
+func (srv *server) notifyReport(ctx context.Context, report statequery.Report, names []string) ([]statequery.Delivery, error) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var deliveries []statequery.Delivery
+	var failed []string
+	wg.Add(len(names))
+	for _, name := range names {
+		go func(name string) {
+			defer wg.Done()
+
+			delivery := srv.notifiers[name].(statequery.ReportNotifier).NotifyReport(ctx, report)
+			if delivery.Status == statequery.DeliveryFailed {
+				log.Printf("failed to send report to %s after %d attempts: %s\n", name, delivery.Attempts, delivery.Error)
+			}
+
+			mutex.Lock()
+			deliveries = append(deliveries, delivery)
+			if delivery.Status == statequery.DeliveryFailed {
+				failed = append(failed, name)
+			}
+			mutex.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	// Keep results in a stable order
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Notifier < deliveries[j].Notifier
+	})
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return deliveries, fmt.Errorf("failed to send report to: %s", strings.Join(failed, ", "))
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/statequery"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Identity of Google Chat in the tokens of its requests
+const chatIssuerEmail = "chat@system.gserviceaccount.com"
+
+// Deadline for synchronous responses, Google Chat waits 30 seconds at most
+const chatResponseTimeout = 25 * time.Second
+
+// Usage of commands sent to the Chat app
+var chatUsage = commandUsage("@bqslots")
+
+// Type for Google Chat app events
+type chatEvent struct {
+	Type  string `json:"type"`
+	Space struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"space"`
+	User struct {
+		DisplayName string `json:"displayName"`
+		Email       string `json:"email"`
+	} `json:"user"`
+	Common struct {
+		InvokedFunction string            `json:"invokedFunction"`
+		Parameters      map[string]string `json:"parameters"`
+	} `json:"common"`
+	Message struct {
+		Name         string            `json:"name"`
+		Text         string            `json:"text"`
+		ArgumentText string            `json:"argumentText"`
+		CardsV2      []json.RawMessage `json:"cardsV2"`
+		Thread       struct {
+			Name string `json:"name"`
+		} `json:"thread"`
+	} `json:"message"`
+	// Set on clicks of buttons opening, in or closing dialogs
+	DialogEventType string `json:"dialogEventType"`
+}
+
+// POST /gchat/events: handle events of the Google Chat app, i.e. commands sent to
+// it and clicks on buttons of alert cards, which are answered by updating the card
+func (srv *server) handleChatEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+	if srv.chatVerifier == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("GCHAT_AUDIENCE not configured"))
+		return
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	_, err := srv.chatVerifier.Verify(req.Context(), token)
+	if err != nil {
+		log.Printf("rejected chat request: %v\n", err)
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid bearer token"))
+		return
+	}
+
+	event := chatEvent{}
+	err = json.NewDecoder(req.Body).Decode(&event)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch event.Type {
+	case "ADDED_TO_SPACE":
+		writeJSON(w, http.StatusOK, map[string]string{
+			"text": fmt.Sprintf("Hi! I post alerts on BigQuery reservations and answer commands.\n%s", chatUsage),
+		})
+
+	case "MESSAGE":
+		ctx, cancel := context.WithTimeout(req.Context(), chatResponseTimeout)
+		defer cancel()
+		writeJSON(w, http.StatusOK, srv.chatMessage(ctx, event))
+
+	case "CARD_CLICKED":
+		action := event.Common.InvokedFunction
+		id := event.Common.Parameters["reservation"]
+		user := event.User.Email
+
+		// Adding slots is confirmed in a dialog first, which is closed by its buttons
+		switch {
+		case event.DialogEventType == "CANCEL_DIALOG" || action == statequery.ActionCancel:
+			writeJSON(w, http.StatusOK, chatDialogStatus(""))
+			return
+		case action == statequery.ActionScaleUp && event.DialogEventType == "REQUEST_DIALOG":
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"actionResponse": map[string]interface{}{
+					"type": "DIALOG",
+					"dialogAction": map[string]interface{}{
+						"dialog": map[string]interface{}{"body": statequery.ChatScaleDialog(id, srv.cfg.scaleSlots)},
+					},
+				},
+			})
+			return
+		case action == statequery.ActionScaleUp && event.DialogEventType != "SUBMIT_DIALOG":
+			writeError(w, http.StatusBadRequest, fmt.Errorf("adding slots requires confirmation"))
+			return
+		}
+		log.Printf("chat action %s on %s by %s\n", action, id, user)
+
+		ctx, cancel := context.WithTimeout(req.Context(), chatResponseTimeout)
+		defer cancel()
+		note, err := srv.act(ctx, action, id, user, user)
+		if err != nil {
+			log.Printf("failed chat action %s on %s: %v\n", action, id, err)
+			note = fmt.Sprintf("Failed to %s %s: %v", action, id, err)
+		}
+		if event.DialogEventType == "SUBMIT_DIALOG" {
+			writeJSON(w, http.StatusOK, chatDialogStatus(note))
+			return
+		}
+
+		// Keep the card and note the outcome in the message text
+		text := strings.TrimSpace(fmt.Sprintf("%s\n_%s_", event.Message.Text, note))
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"actionResponse": map[string]string{"type": "UPDATE_MESSAGE"},
+			"text":           text,
+			"cardsV2":        event.Message.CardsV2,
+		})
+
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{})
+	}
+}
+
+// Answer a message sent to the Chat app. Scans take longer than Google Chat waits
+// for a response, so their results are posted to the thread of the message later.
+func (srv *server) chatMessage(ctx context.Context, event chatEvent) map[string]string {
+	text := strings.TrimSpace(event.Message.ArgumentText)
+	if text == "" && event.Space.Type == "DM" {
+		text = strings.TrimSpace(event.Message.Text)
+	}
+	user := event.User.Email
+	log.Printf("chat message from %s: %s\n", user, text)
+
+	if fields := strings.Fields(text); len(fields) > 0 && fields[0] == "refresh" {
+		if srv.chat == nil {
+			return map[string]string{"text": "Refreshing is unavailable, the Chat API client is not configured."}
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+			defer cancel()
+			reply := srv.command(ctx, text, user, chatUsage)
+			_, err := srv.chat.PostMessage(ctx, event.Space.Name, reply.Text, nil, event.Message.Thread.Name)
+			if err != nil {
+				log.Printf("failed to reply to chat message: %v\n", err)
+			}
+		}()
+		return map[string]string{"text": "Scanning reservations, results will follow..."}
+	}
+
+	return map[string]string{"text": srv.command(ctx, text, user, chatUsage).Text}
+}
+
+// Response closing a dialog, showing the note to the user if set
+func chatDialogStatus(note string) map[string]interface{} {
+	status := map[string]string{"statusCode": "OK"}
+	if note != "" {
+		status["userFacingMessage"] = note
+	}
+	return map[string]interface{}{
+		"actionResponse": map[string]interface{}{
+			"type":         "DIALOG",
+			"dialogAction": map[string]interface{}{"actionStatus": status},
+		},
+	}
+}
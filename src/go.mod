@@ -20,6 +20,7 @@ require (
 	cloud.google.com/go/bigquery v1.54.0
 	cloud.google.com/go/storage v1.32.0
 	google.golang.org/api v0.138.0
+	google.golang.org/protobuf v1.31.0
 )
 
 require (
@@ -47,5 +48,4 @@ require (
 	google.golang.org/genproto/googleapis/api v0.0.0-20230803162519-f966b187b2e5 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20230807174057-1744710a1577 // indirect
 	google.golang.org/grpc v1.57.0 // indirect
-	google.golang.org/protobuf v1.31.0 // indirect
 )
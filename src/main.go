@@ -23,16 +23,58 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Type for global configuration data
 type config struct {
-	port      string
-	project   string
-	locations []string
-	threshold float64
-	bucket    string
+	port          string
+	project       string
+	adminProjects []string
+	namespaced    bool
+	locations     []string
+	threshold     float64
+	bucket        string
+	cacheSize     int
+	cacheStore    string
+	resolver      string
+	audience      string
+	invokers      []string
+
+	forecastWindow  time.Duration
+	forecastHorizon time.Duration
+
+	alertMode         string
+	anomalyStdDevs    float64
+	anomalyWindow     time.Duration
+	anomalyMinSamples int
+
+	runawayPolicy *statequery.RunawayPolicy
+
+	maintenanceWindows []statequery.MaintenanceWindow
+
+	pubsubTopic string
+
+	snoozeFor     time.Duration
+	scaleSlots    int64
+	scaleMaxSlots int64
+	scaleUsers    map[string]bool
+	chatAudience  string
+	templates     statequery.TemplateSources
+
+	digestNotifiers []string
+
+	chargebackLabel string
+	chargebackTable string
+
+	prices statequery.PriceTable
+
+	rightsizingWindow    time.Duration
+	rightsizingNotifiers []string
+
+	notifiers []notifierConfig
+	router    statequery.Router
 }
 
 func main() {
@@ -44,79 +86,112 @@ func main() {
 	// e.g. Cloud Run (with --min-instances 0) is likely to regularly dispose the serving
 	// instances. The maxTTL setting helps with executing this service on long-lived
 	// infrastructure, where it is required to eventually refreshed the cache entries.
+	// Stale entries keep being served while they are refreshed in the background.
 	cache := &statequery.Cache{}
-	cache.Initialize(time.Hour)
+	cache.Initialize(time.Hour, cfg.cacheSize)
 
 	ctx := context.Background()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		// Always respond with JSON
-		w.Header().Set("Content-Type", "application/json")
-
-		log.Println("starting analysis")
-
-		// Start from a clean slate and track state
-		state := statequery.State{}
-
-		// Retrieve all BQ reservations from current (admin) project
-		err := state.RetrieveReservations(ctx, cfg.project, cfg.locations)
+	// Share the cache across instances and restarts through a backing store, if configured
+	if cfg.cacheStore != "" {
+		store, err := statequery.NewCacheStore(ctx, cfg.cacheStore)
 		if err != nil {
-			log.Fatalf("failed to retrieve reservations: %v\n", err)
+			log.Fatalf("failed to create cache store: %v\n", err)
 		}
-
-		// Abort if no reservations have been found
-		if len(state.Reservations) == 0 {
-			json.NewEncoder(w).Encode(state)
-			return
+		err = cache.Attach(ctx, store)
+		if err != nil {
+			log.Printf("failed to load cache from store, continuing without it: %v\n", err)
 		}
+	}
 
-		// Retrieve all assignments for each reservation
-		err = state.RetrieveAssignments(ctx, cfg.project, cache)
+	// Resolve folder/org assignees to projects through the configured API, feeding the cache
+	resolver, err := statequery.NewHierarchyResolver(ctx, cfg.resolver, cache)
+	if err != nil {
+		log.Fatalf("failed to create hierarchy resolver: %v\n", err)
+	}
+
+	// Verify OIDC tokens of callers in-app, if an audience is configured
+	var verifier *statequery.TokenVerifier
+	if cfg.audience != "" {
+		verifier, err = statequery.NewTokenVerifier(ctx, cfg.audience, cfg.invokers, nil)
 		if err != nil {
-			log.Fatalf("failed to retrieve assignments: %v\n", err)
+			log.Fatalf("failed to create token verifier: %v\n", err)
 		}
+	}
 
-		// Retrieve info for all running jobs from projects with reservations
-		err = state.RetrieveJobs(ctx)
+	// Verify tokens of Google Chat app events, if an audience is configured
+	var chatVerifier *statequery.TokenVerifier
+	if cfg.chatAudience != "" {
+		chatVerifier, err = statequery.NewTokenVerifier(ctx, cfg.chatAudience, []string{chatIssuerEmail}, nil)
 		if err != nil {
-			log.Fatalf("failed to retrieve jobs: %v\n", err)
+			log.Fatalf("failed to create chat token verifier: %v\n", err)
 		}
+	}
 
-		// Compute utilization totals
-		state.ComputeUtilization(cfg.threshold)
-
-		err = state.DumpState(ctx, cfg.bucket)
+	// Post as Google Chat app, if it is set up or notifiers post through it
+	var chat *statequery.ChatClient
+	if cfg.chatAudience != "" || cfg.usesChatApp() {
+		chat, err = statequery.NewChatClient(ctx, statequery.DeliveryPolicy{})
 		if err != nil {
-			log.Fatalf("failed to dump state: %v\n", err)
+			log.Fatalf("failed to create chat client: %v\n", err)
 		}
+	}
 
-		// Abort if no reservation is breaching its threshold
-		alert := false
-		for _, reservation := range state.Reservations {
-			if reservation.ThresholdBreached {
-				alert = true
-			}
-		}
-		if !alert {
-			json.NewEncoder(w).Encode(state)
-			return
-		}
+	// Post as Slack app with the bot token, which is read on every call
+	slack := statequery.NewSlackClient(func() string {
+		return readSecret("SLACK_BOT_TOKEN", "/slack-bot/token")
+	}, statequery.DeliveryPolicy{})
+
+	// Parse and validate message templates up front, failing on mistakes
+	templates, err := statequery.LoadTemplates(ctx, cfg.templates)
+	if err != nil {
+		log.Fatalf("failed to load templates: %v\n", err)
+	}
+
+	// Create notifiers, which alerts are routed to
+	notifiers, err := cfg.buildNotifiers(ctx, templates, slack, chat)
+	if err != nil {
+		log.Fatalf("failed to create notifiers: %v\n", err)
+	}
 
-		// Render message from template
-		message, err := state.RenderMessage()
+	// Persist silences next to the state dumps, if a bucket is configured
+	var silences *statequery.SilenceStore
+	if cfg.bucket != "" {
+		silences, err = statequery.NewSilenceStore(ctx, cfg.bucket)
 		if err != nil {
-			log.Fatalf("failed to render message: %v\n", err)
+			log.Fatalf("failed to create silence store: %v\n", err)
 		}
+	}
+
+	// Track open incidents across runs, in the bucket if configured
+	incidents, err := statequery.NewIncidentStore(ctx, cfg.bucket)
+	if err != nil {
+		log.Fatalf("failed to create incident store: %v\n", err)
+	}
 
-		// Push rendered message to all defined chat webhooks
-		err = statequery.SendMessage(cfg.hooks(), message)
+	// Publish states and alert transitions to Pub/Sub, if configured
+	var publisher *statequery.Publisher
+	if cfg.pubsubTopic != "" {
+		publisher, err = statequery.NewPublisher(ctx, cfg.pubsubTopic)
 		if err != nil {
-			log.Fatalf("failed to send message: %v\n", err)
+			log.Fatalf("failed to create publisher: %v\n", err)
 		}
+	}
 
-		// Encode state to HTTP response
-		json.NewEncoder(w).Encode(state)
-	})
+	srv := &server{
+		cfg:          &cfg,
+		cache:        cache,
+		resolver:     resolver,
+		notifiers:    notifiers,
+		silences:     silences,
+		incidents:    incidents,
+		publisher:    publisher,
+		chatVerifier: chatVerifier,
+		chat:         chat,
+		slack:        slack,
+		templates:    templates,
+	}
+	srv.routes(http.DefaultServeMux, verifier)
 
 	log.Println("listening for connections")
 	http.ListenAndServe(fmt.Sprintf(":%s", cfg.port), nil)
@@ -133,6 +208,27 @@ func (cfg *config) configure() {
 	// Set admin GCP project, which holds BQ reservations/assignments
 	cfg.project = os.Getenv("GOOGLE_CLOUD_PROJECT")
 
+	// Read further admin projects, e.g. per business unit, defaulting to the above
+	for _, project := range strings.Split(os.Getenv("ADMIN_PROJECTS"), ",") {
+		project = strings.TrimSpace(project)
+		if project != "" {
+			cfg.adminProjects = append(cfg.adminProjects, project)
+		}
+	}
+	if len(cfg.adminProjects) == 0 && cfg.project != "" {
+		cfg.adminProjects = []string{cfg.project}
+	}
+
+	// Prefix reservation IDs with their admin project. Changes the IDs that incidents,
+	// silences and history are keyed by, so it is never switched on implicitly.
+	namespaced, err := strconv.ParseBool(os.Getenv("NAMESPACE_RESERVATIONS"))
+	if err == nil {
+		cfg.namespaced = namespaced
+	}
+	if len(cfg.adminProjects) > 1 && !cfg.namespaced {
+		log.Fatalf("NAMESPACE_RESERVATIONS is required with more than one admin project\n")
+	}
+
 	// Configure locations for resolution of BQ reservations
 	cfg.locations = []string{
 		"US",
@@ -179,29 +275,212 @@ func (cfg *config) configure() {
 
 	//Bucket to dump state to
 	cfg.bucket = os.Getenv("STATE_BUCKET")
-}
 
-// Get a webhook url for a given chat service.
-// Unlike the rest of the configuration, this is kept dynamic to ensure that always
-// the latest version of the secret webhook are loaded and used.
-func (cfg *config) hooks() map[string]string {
-	hooks := make(map[string]string)
-
-	// Read secret webhooks from ENV vars
-	hooks["slack"] = os.Getenv("SLACK_WEBHOOK_URL")
-	hooks["gchat"] = os.Getenv("GCHAT_WEBHOOK_URL")
-
-	//Override secret webhooks from secret volume mounts, if available
-	for service := range hooks {
-		file := fmt.Sprintf("/%s/webhook", service)
-		_, err := os.Stat(file)
-		if err == nil {
-			secret, err := os.ReadFile(file)
+	// Bound the number of resource manager cache entries
+	size, err := strconv.Atoi(os.Getenv("CACHE_MAX_ENTRIES"))
+	if err != nil {
+		log.Println("failed to parse cache size from CACHE_MAX_ENTRIES, defaulting to 10000")
+		size = 10000
+	}
+	cfg.cacheSize = size
+
+	// Backing store for the resource manager cache (gs://bucket/object or local path)
+	cfg.cacheStore = os.Getenv("CACHE_STORE")
+
+	// API to resolve folder/org assignees with ('resourcemanager' or 'assetinventory')
+	cfg.resolver = os.Getenv("HIERARCHY_RESOLVER")
+
+	// Expected audience and (optionally) identities of OIDC tokens sent by invokers
+	cfg.audience = os.Getenv("AUTH_AUDIENCE")
+	for _, email := range strings.Split(os.Getenv("AUTH_ALLOWED_EMAILS"), ",") {
+		email = strings.TrimSpace(email)
+		if email != "" {
+			cfg.invokers = append(cfg.invokers, email)
+		}
+	}
+
+	// Forecast utilization over the horizon from a window of history (disabled by default)
+	cfg.forecastWindow = durationEnv("FORECAST_WINDOW", 3*time.Hour)
+	cfg.forecastHorizon = durationEnv("FORECAST_HORIZON", 0)
+
+	// Alert on fixed threshold ('threshold') or deviations from seasonal baselines ('anomaly')
+	cfg.alertMode = os.Getenv("ALERT_MODE")
+	if cfg.alertMode == "" {
+		cfg.alertMode = "threshold"
+	}
+	stddevs, err := strconv.ParseFloat(os.Getenv("ANOMALY_STDDEVS"), 64)
+	if err != nil {
+		stddevs = 3
+	}
+	cfg.anomalyStdDevs = stddevs
+	cfg.anomalyWindow = durationEnv("ANOMALY_WINDOW", 4*7*24*time.Hour)
+	samples, err := strconv.Atoi(os.Getenv("ANOMALY_MIN_SAMPLES"))
+	if err != nil {
+		samples = 6
+	}
+	cfg.anomalyMinSamples = samples
+
+	// Policy for runaway jobs as JSON (disabled by default)
+	policy := os.Getenv("RUNAWAY_POLICY")
+	if policy != "" {
+		cfg.runawayPolicy = &statequery.RunawayPolicy{}
+		err = json.Unmarshal([]byte(policy), cfg.runawayPolicy)
+		if err != nil {
+			log.Fatalf("failed to parse RUNAWAY_POLICY: %v\n", err)
+		}
+	}
+
+	// Recurring maintenance windows as JSON, suppressing alerts while active
+	windows := os.Getenv("MAINTENANCE_WINDOWS")
+	if windows != "" {
+		err = json.Unmarshal([]byte(windows), &cfg.maintenanceWindows)
+		if err != nil {
+			log.Fatalf("failed to parse MAINTENANCE_WINDOWS: %v\n", err)
+		}
+		for i := range cfg.maintenanceWindows {
+			err = cfg.maintenanceWindows[i].Compile()
 			if err != nil {
-				log.Fatalf("failed to read secret from volume mount: %s\n", file)
+				log.Fatalf("failed to parse MAINTENANCE_WINDOWS: %v\n", err)
 			}
-			hooks[service] = string(secret)
 		}
 	}
-	return hooks
+
+	// Pub/Sub topic for states and alert transitions, by name or as full resource name
+	cfg.pubsubTopic = os.Getenv("PUBSUB_TOPIC")
+	if cfg.pubsubTopic != "" && !strings.HasPrefix(cfg.pubsubTopic, "projects/") {
+		cfg.pubsubTopic = fmt.Sprintf("projects/%s/topics/%s", cfg.project, cfg.pubsubTopic)
+	}
+
+	// Actions on alert messages: snooze duration and slots added by the scale-up button
+	// (hidden unless set), bounded by a maximum reservation size and restricted to the
+	// users allowed to scale, both required along with it
+	cfg.snoozeFor = durationEnv("SNOOZE_DURATION", time.Hour)
+	scaleSlots, err := strconv.ParseInt(os.Getenv("SCALE_UP_SLOTS"), 10, 64)
+	if err == nil {
+		cfg.scaleSlots = scaleSlots
+	}
+	scaleMaxSlots, err := strconv.ParseInt(os.Getenv("SCALE_UP_MAX_SLOTS"), 10, 64)
+	if err == nil {
+		cfg.scaleMaxSlots = scaleMaxSlots
+	}
+	if cfg.scaleSlots > 0 && cfg.scaleMaxSlots <= 0 {
+		log.Fatalf("SCALE_UP_MAX_SLOTS is required when SCALE_UP_SLOTS is set\n")
+	}
+	cfg.scaleUsers = make(map[string]bool)
+	for _, user := range strings.Split(os.Getenv("SCALE_UP_USERS"), ",") {
+		user = strings.TrimSpace(user)
+		if user != "" {
+			cfg.scaleUsers[user] = true
+		}
+	}
+	if cfg.scaleSlots > 0 && len(cfg.scaleUsers) == 0 {
+		log.Fatalf("SCALE_UP_USERS is required when SCALE_UP_SLOTS is set\n")
+	}
+
+	// Audience of tokens sent by Google Chat to the app endpoint (the endpoint URL)
+	cfg.chatAudience = os.Getenv("GCHAT_AUDIENCE")
+
+	// Message templates by kind, replacing the built-in ones for all notifiers
+	templates := os.Getenv("TEMPLATES")
+	if templates != "" {
+		err = json.Unmarshal([]byte(templates), &cfg.templates)
+		if err != nil {
+			log.Fatalf("failed to parse TEMPLATES: %v\n", err)
+		}
+	}
+
+	// Named notifier instances as JSON, in addition to or replacing the built-in ones, see defaultNotifiers
+	var extra []notifierConfig
+	notifiers := os.Getenv("NOTIFIERS")
+	if notifiers != "" {
+		err = json.Unmarshal([]byte(notifiers), &extra)
+		if err != nil {
+			log.Fatalf("failed to parse NOTIFIERS: %v\n", err)
+		}
+	}
+	replaced := make(map[string]bool)
+	for _, notifier := range extra {
+		replaced[notifier.Name] = true
+	}
+	for _, notifier := range defaultNotifiers() {
+		if !replaced[notifier.Name] {
+			cfg.notifiers = append(cfg.notifiers, notifier)
+		}
+	}
+	cfg.notifiers = append(cfg.notifiers, extra...)
+
+	// Routing rules as JSON, defaulting to all notifiers for all reservations
+	routes := os.Getenv("ROUTES")
+	if routes != "" {
+		err = json.Unmarshal([]byte(routes), &cfg.router)
+		if err != nil {
+			log.Fatalf("failed to parse ROUTES: %v\n", err)
+		}
+	} else {
+		for _, notifier := range cfg.notifiers {
+			cfg.router.Default = append(cfg.router.Default, notifier.Name)
+		}
+	}
+
+	// Notifiers receiving digests, defaulting to the default route
+	for _, name := range strings.Split(os.Getenv("DIGEST_NOTIFIERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			cfg.digestNotifiers = append(cfg.digestNotifiers, name)
+		}
+	}
+	if len(cfg.digestNotifiers) == 0 {
+		cfg.digestNotifiers = cfg.router.Default
+	}
+
+	// Read slot prices overriding the built-in list prices
+	cfg.prices = statequery.DefaultPrices
+	prices := os.Getenv("SLOT_PRICES")
+	if prices != "" {
+		overrides := statequery.PriceTable{}
+		err = json.Unmarshal([]byte(prices), &overrides)
+		if err != nil {
+			log.Fatalf("failed to parse SLOT_PRICES: %v\n", err)
+		}
+		cfg.prices = cfg.prices.Merge(overrides)
+	}
+	err = cfg.prices.Validate()
+	if err != nil {
+		log.Fatalf("invalid SLOT_PRICES: %v\n", err)
+	}
+
+	// Window of right-sizing recommendations, and notifiers posting them
+	cfg.rightsizingWindow = durationEnv("RIGHTSIZING_WINDOW", 4*7*24*time.Hour)
+	for _, name := range strings.Split(os.Getenv("RIGHTSIZING_NOTIFIERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			cfg.rightsizingNotifiers = append(cfg.rightsizingNotifiers, name)
+		}
+	}
+
+	// Read job label key and optional BigQuery table of chargeback reports
+	cfg.chargebackLabel = os.Getenv("CHARGEBACK_LABEL")
+	cfg.chargebackTable = os.Getenv("CHARGEBACK_TABLE")
+}
+
+// Admin project of reservations not namespaced by theirs, i.e. the only one
+func (cfg *config) adminProject() string {
+	if len(cfg.adminProjects) == 0 {
+		return ""
+	}
+	return cfg.adminProjects[0]
+}
+
+// Parse a duration from an ENV var, falling back to a default
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("failed to parse duration from %s, defaulting to %v\n", name, fallback)
+		return fallback
+	}
+	return duration
 }
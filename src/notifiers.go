@@ -0,0 +1,214 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"main/statequery"
+	"os"
+	"strings"
+)
+
+// Type for configuration of a named notifier instance
+type notifierConfig struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	WebhookEnv  string `json:"webhook_env"`
+	WebhookFile string `json:"webhook_file"`
+
+	// SMTP server, credentials and recipients of email notifiers
+	SMTPHost         string   `json:"smtp_host"`
+	SMTPPort         int      `json:"smtp_port"`
+	SMTPSecurity     string   `json:"smtp_security"`
+	SMTPUsername     string   `json:"smtp_username"`
+	SMTPPasswordEnv  string   `json:"smtp_password_env"`
+	SMTPPasswordFile string   `json:"smtp_password_file"`
+	From             string   `json:"from"`
+	To               []string `json:"to"`
+
+	// Channel of Slack app notifiers, posted to with the bot token
+	Channel string `json:"channel"`
+
+	// Space (spaces/<space>) of Google Chat app notifiers
+	Space string `json:"space"`
+
+	// Message templates by kind, replacing the ones of TEMPLATES for this notifier
+	Templates statequery.TemplateSources `json:"templates"`
+
+	// Whether to add action buttons to Slack and Google Chat app messages, which
+	// requires a Slack app with interactivity enabled or the Google Chat app
+	Interactive bool `json:"interactive"`
+
+	// Timeout and retries of deliveries to this notifier
+	statequery.DeliveryPolicy
+}
+
+// Built-in notifiers, configured through ENV vars or secret volume mounts. The
+// 'teams' notifier is only built in if TEAMS_WEBHOOK_URL is set, otherwise it
+// needs an entry in NOTIFIERS, e.g. to read its webhook from /teams/webhook.
+func defaultNotifiers() []notifierConfig {
+	services := []string{"slack", "gchat"}
+	if os.Getenv("TEAMS_WEBHOOK_URL") != "" {
+		services = append(services, "teams")
+	}
+
+	var notifiers []notifierConfig
+	for _, service := range services {
+		notifiers = append(notifiers, notifierConfig{
+			Name:        service,
+			Type:        service,
+			WebhookEnv:  fmt.Sprintf("%s_WEBHOOK_URL", strings.ToUpper(service)),
+			WebhookFile: fmt.Sprintf("/%s/webhook", service),
+		})
+	}
+	return notifiers
+}
+
+// Whether any notifier posts through the Google Chat app
+func (cfg *config) usesChatApp() bool {
+	for _, notifier := range cfg.notifiers {
+		if notifier.Type == "gchat-app" {
+			return true
+		}
+	}
+	return false
+}
+
+// Create all configured notifier instances by name. Notifiers render the given
+// templates, unless they override some, and Slack and Google Chat app notifiers
+// post through the given clients.
+func (cfg *config) buildNotifiers(ctx context.Context, defaults *statequery.Templates, slack *statequery.SlackClient, chat *statequery.ChatClient) (map[string]statequery.Notifier, error) {
+	notifiers := make(map[string]statequery.Notifier)
+	for _, notifier := range cfg.notifiers {
+		if _, ok := notifiers[notifier.Name]; ok {
+			return nil, fmt.Errorf("duplicate notifier name: %s", notifier.Name)
+		}
+
+		templates := defaults
+		if len(notifier.Templates) > 0 {
+			var err error
+			templates, err = statequery.LoadTemplates(ctx, cfg.templates, notifier.Templates)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load templates of notifier %s: %v", notifier.Name, err)
+			}
+		}
+
+		switch notifier.Type {
+		case "slack", "gchat":
+			webhook := statequery.NewWebhookNotifier(notifier.Name, notifier.webhook, templates, notifier.DeliveryPolicy)
+			if notifier.Interactive && notifier.Type == "slack" {
+				webhook.Actions = cfg.actions()
+			}
+			webhook.Threaded = notifier.Type == "gchat"
+			notifiers[notifier.Name] = webhook
+		case "slack-app":
+			app, err := statequery.NewSlackNotifier(notifier.Name, notifier.Channel, slack, templates, notifier.DeliveryPolicy)
+			if err != nil {
+				return nil, err
+			}
+			if notifier.Interactive {
+				app.Actions = cfg.actions()
+			}
+			notifiers[notifier.Name] = app
+		case "gchat-app":
+			app, err := statequery.NewChatNotifier(notifier.Name, notifier.Space, chat, templates, notifier.DeliveryPolicy)
+			if err != nil {
+				return nil, err
+			}
+			if notifier.Interactive {
+				app.Actions = cfg.actions()
+			}
+			notifiers[notifier.Name] = app
+		case "teams":
+			notifiers[notifier.Name] = statequery.NewTeamsNotifier(notifier.Name, notifier.webhook, templates, notifier.DeliveryPolicy)
+		case "email":
+			email, err := statequery.NewEmailNotifier(notifier.Name, notifier.email(), templates, notifier.DeliveryPolicy)
+			if err != nil {
+				return nil, err
+			}
+			notifiers[notifier.Name] = email
+		default:
+			return nil, fmt.Errorf("unknown type %s of notifier %s", notifier.Type, notifier.Name)
+		}
+	}
+
+	// Make sure routes only refer to existing notifiers
+	names := append([]string{}, cfg.router.Default...)
+	for _, route := range cfg.router.Routes {
+		names = append(names, route.Notifiers...)
+	}
+	for _, name := range names {
+		if _, ok := notifiers[name]; !ok {
+			return nil, fmt.Errorf("route refers to unknown notifier: %s", name)
+		}
+	}
+	for _, name := range cfg.digestNotifiers {
+		if _, ok := notifiers[name].(statequery.ReportNotifier); !ok {
+			return nil, fmt.Errorf("unknown notifier for digests: %s", name)
+		}
+	}
+	for _, name := range cfg.rightsizingNotifiers {
+		if _, ok := notifiers[name].(statequery.ReportNotifier); !ok {
+			return nil, fmt.Errorf("unknown notifier for right-sizing reports: %s", name)
+		}
+	}
+	return notifiers, nil
+}
+
+// Get the webhook url of a notifier.
+// Unlike the rest of the configuration, this is kept dynamic to ensure that always
+// the latest version of the secret webhook are loaded and used.
+func (notifier notifierConfig) webhook() string {
+	return readSecret(notifier.WebhookEnv, notifier.WebhookFile)
+}
+
+// Get the SMTP settings of an email notifier. The password is read dynamically,
+// like webhooks.
+func (notifier notifierConfig) email() statequery.EmailConfig {
+	return statequery.EmailConfig{
+		Host:     notifier.SMTPHost,
+		Port:     notifier.SMTPPort,
+		Security: notifier.SMTPSecurity,
+		Username: notifier.SMTPUsername,
+		Password: func() string {
+			return readSecret(notifier.SMTPPasswordEnv, notifier.SMTPPasswordFile)
+		},
+		From: notifier.From,
+		To:   notifier.To,
+	}
+}
+
+// Read a secret from an ENV var, overridden by a secret volume mount, if available
+func readSecret(env string, file string) string {
+	secret := ""
+	if env != "" {
+		secret = os.Getenv(env)
+	}
+
+	if file != "" {
+		_, err := os.Stat(file)
+		if err == nil {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				log.Printf("failed to read secret from volume mount: %s\n", file)
+				return secret
+			}
+			secret = strings.TrimSpace(string(data))
+		}
+	}
+	return secret
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"main/statequery"
+	"net/http"
+	"time"
+)
+
+// Type for responses of the right-sizing endpoint
+type rightsizingResponse struct {
+	*statequery.Rightsizing
+	Deliveries []statequery.Delivery `json:"deliveries,omitempty"`
+}
+
+// GET /rightsizing?window=672h: recommend the capacity of all reservations from
+// the states archived within the window, defaulting to RIGHTSIZING_WINDOW.
+// POST additionally posts the recommendations to the right-sizing notifiers and
+// responds with status 500 if any notifier failed, so schedulers retry.
+func (srv *server) handleRightsizing(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	window := srv.cfg.rightsizingWindow
+	if value := req.URL.Query().Get("window"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid window: %s", value))
+			return
+		}
+		window = parsed
+	}
+
+	// Recommend without comparing to commitments, rather than not at all
+	commitments, err := statequery.RetrieveCommitments(req.Context(), srv.cfg.adminProjects, srv.cfg.locations)
+	if err != nil {
+		log.Printf("failed to retrieve capacity commitments: %v\n", err)
+	}
+
+	to := time.Now().UTC()
+	rightsizing, err := statequery.AnalyzeRightsizing(req.Context(), srv.cfg.bucket, to.Add(-window), to, srv.cfg.threshold, commitments, srv.cfg.prices)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no history available: %v", err))
+		return
+	}
+	log.Printf("analyzed sizes of %d reservations\n", len(rightsizing.Reservations))
+
+	response := rightsizingResponse{Rightsizing: rightsizing}
+	if req.Method == http.MethodPost {
+		response.Deliveries, err = srv.notifyReport(req.Context(), rightsizing, srv.cfg.rightsizingNotifiers)
+		if err != nil {
+			log.Printf("%v\n", err)
+			writeJSON(w, http.StatusInternalServerError, response)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
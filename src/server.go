@@ -0,0 +1,465 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"main/statequery"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type holding long-lived clients and the last computed state, shared by all handlers
+type server struct {
+	cfg       *config
+	cache     *statequery.Cache
+	resolver  statequery.HierarchyResolver
+	notifiers map[string]statequery.Notifier
+	silences  *statequery.SilenceStore
+	incidents *statequery.IncidentStore
+	publisher *statequery.Publisher
+	slack     *statequery.SlackClient
+	templates *statequery.Templates
+
+	// Verifies requests of the Google Chat app, and posts as it
+	chatVerifier *statequery.TokenVerifier
+	chat         *statequery.ChatClient
+
+	// Serializes scans, so concurrent triggers do not send duplicate alerts
+	scanMutex sync.Mutex
+
+	// Guards the last computed state
+	mutex sync.Mutex
+	last  *statequery.State
+
+	// Seasonal baselines for anomaly detection, rebuilt periodically
+	baselineMutex sync.Mutex
+	baselines     *statequery.Baselines
+}
+
+// Interval after which seasonal baselines are rebuilt from history
+const baselineRefresh = time.Hour
+
+// Type for JSON error responses
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Type for health and readiness responses
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Register all routes on the given mux. Everything but health checks, the dashboard
+// assets and chat callbacks (verified by their signature or token) requires
+// authentication, if enabled.
+func (srv *server) routes(mux *http.ServeMux, verifier *statequery.TokenVerifier) {
+	mux.HandleFunc("/", verifier.Require(srv.handleRoot))
+	mux.HandleFunc("/scan", verifier.Require(srv.handleScan))
+	mux.HandleFunc("/status", verifier.Require(srv.handleStatus))
+	mux.HandleFunc("/reservations/", verifier.Require(srv.handleReservation))
+	mux.HandleFunc("/history", verifier.Require(srv.handleHistory))
+	mux.HandleFunc("/routes/test", verifier.Require(srv.handleRoutesTest))
+	mux.HandleFunc("/digest", verifier.Require(srv.handleDigest))
+	mux.HandleFunc("/chargeback", verifier.Require(srv.handleChargeback))
+	mux.HandleFunc("/rightsizing", verifier.Require(srv.handleRightsizing))
+	mux.HandleFunc("/silences", verifier.Require(srv.handleSilences))
+	mux.HandleFunc("/silences/", verifier.Require(srv.handleSilence))
+	mux.HandleFunc("/slack/commands", srv.handleSlackCommand)
+	mux.HandleFunc("/slack/events", srv.handleSlackEvents)
+	mux.HandleFunc("/slack/actions", srv.handleSlackActions)
+	mux.HandleFunc("/gchat/events", srv.handleChatEvents)
+	mux.HandleFunc("/dashboard/", verifier.Require(dashboardHandler().ServeHTTP))
+	mux.HandleFunc("/healthz", srv.handleHealth)
+	mux.HandleFunc("/readyz", srv.handleReady)
+}
+
+// Run the full pipeline: retrieve reservations, assignments and jobs, and compute
+// utilization. Does not send any alerts or archive the resulting state. Runaway
+// jobs are only cancelled if cancelRunaways is set, otherwise they are reported as
+// in dry-run mode.
+func (srv *server) scan(ctx context.Context, cancelRunaways bool) (*statequery.State, error) {
+	log.Println("starting analysis")
+
+	// Start from a clean slate and track state
+	state := &statequery.State{Timestamp: time.Now().UTC()}
+
+	// Retrieve all BQ reservations from all admin projects
+	err := state.RetrieveReservations(ctx, srv.cfg.adminProjects, srv.cfg.locations, srv.cfg.namespaced)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve reservations: %v", err)
+	}
+
+	// Abort if no reservations have been found
+	if len(state.Reservations) == 0 {
+		return state, nil
+	}
+
+	// Retrieve all assignments for each reservation
+	err = state.RetrieveAssignments(ctx, srv.cfg.adminProject(), srv.resolver)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve assignments: %v", err)
+	}
+
+	// Write back any cache changes to the backing store
+	err = srv.cache.Persist(ctx)
+	if err != nil {
+		log.Printf("failed to persist cache: %v\n", err)
+	}
+
+	// Track resource manager cache effectiveness
+	stats := srv.cache.Stats()
+	state.Cache = &stats
+
+	// Retrieve info for all running jobs from projects with reservations
+	err = state.RetrieveJobs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve jobs: %v", err)
+	}
+
+	// Compute utilization totals
+	state.ComputeUtilization(srv.cfg.threshold)
+
+	// Replace the fixed threshold with seasonal baselines, if enabled
+	if srv.cfg.alertMode == "anomaly" {
+		baselines, err := srv.seasonalBaselines(ctx)
+		if err != nil {
+			log.Printf("failed to build baselines, falling back to threshold: %v\n", err)
+		} else {
+			state.DetectAnomalies(baselines, srv.cfg.anomalyStdDevs, srv.cfg.anomalyMinSamples)
+		}
+	}
+
+	// Forecast utilization trends from archived states, if enabled
+	if srv.cfg.forecastHorizon > 0 {
+		history, err := statequery.LoadHistory(ctx, srv.cfg.bucket, state.Timestamp.Add(-srv.cfg.forecastWindow))
+		if err != nil {
+			log.Printf("failed to load history for forecasts: %v\n", err)
+		} else {
+			state.ComputeForecasts(history, srv.cfg.threshold, srv.cfg.forecastHorizon)
+		}
+	}
+
+	// Estimate costs of the capacity and of the slots recommended by forecasts
+	state.EstimateCosts(srv.cfg.prices)
+
+	// Identify (and optionally cancel) runaway jobs, if a policy is configured
+	if srv.cfg.runawayPolicy != nil {
+		policy := srv.cfg.runawayPolicy
+		if !cancelRunaways {
+			policy = policy.ReadOnly()
+		}
+		err = state.EvaluateRunaways(ctx, policy)
+		if err != nil {
+			log.Printf("failed to evaluate runaway policy: %v\n", err)
+		}
+	}
+
+	// Suppress alerts for reservations covered by silences or maintenance windows
+	srv.applySuppressions(ctx, state)
+
+	return state, nil
+}
+
+// Send alerts for a computed state to the notifiers its alerting reservations are
+// routed to, concurrently. Delivery results are recorded in the state, and alerts
+// which could not be delivered are archived as dead letters.
+func (srv *server) notify(ctx context.Context, state *statequery.State) error {
+	dispatched := srv.cfg.router.Dispatch(state)
+
+	// Resolve incidents on the threaded notifiers which posted about them
+	resolved := make(map[string][]statequery.Transition)
+	for _, transition := range state.Transitions {
+		if transition.Status != statequery.TransitionResolved {
+			continue
+		}
+		for name := range transition.Threads {
+			if _, ok := srv.notifiers[name].(statequery.ThreadedNotifier); ok {
+				resolved[name] = append(resolved[name], transition)
+			}
+		}
+	}
+
+	// Create sync for concurrent deliveries
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var failed []string
+	deliver := func(name string, routed *statequery.State, send func() statequery.Delivery) {
+		defer wg.Done()
+
+		delivery := send()
+		if len(delivery.Threads) > 0 {
+			err := srv.incidents.SaveThreads(ctx, name, delivery.Threads)
+			if err != nil {
+				log.Printf("failed to save threads of %s: %v\n", name, err)
+			}
+		}
+		if delivery.Status == statequery.DeliveryFailed {
+			log.Printf("failed to notify %s after %d attempts: %s\n", name, delivery.Attempts, delivery.Error)
+			object, err := statequery.WriteDeadLetter(ctx, srv.cfg.bucket, delivery, routed)
+			if err != nil {
+				log.Printf("failed to write dead letter for %s: %v\n", name, err)
+			}
+			delivery.DeadLetter = object
+		}
+
+		mutex.Lock()
+		state.Deliveries = append(state.Deliveries, delivery)
+		if delivery.Status == statequery.DeliveryFailed {
+			failed = append(failed, name)
+		}
+		mutex.Unlock()
+	}
+
+	wg.Add(len(dispatched) + len(resolved))
+	for name, routed := range dispatched {
+		notifier, routed := srv.notifiers[name], routed
+		go deliver(name, routed, func() statequery.Delivery {
+			return notifier.Notify(ctx, routed)
+		})
+	}
+	for name, transitions := range resolved {
+		notifier := srv.notifiers[name].(statequery.ThreadedNotifier)
+		transitions := transitions
+		go deliver(name, &statequery.State{Timestamp: state.Timestamp, Transitions: transitions}, func() statequery.Delivery {
+			return notifier.Resolve(ctx, transitions)
+		})
+	}
+	wg.Wait()
+
+	// Keep results in a stable order
+	sort.Slice(state.Deliveries, func(i, j int) bool {
+		return state.Deliveries[i].Notifier < state.Deliveries[j].Notifier
+	})
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to send message to: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Get the seasonal baselines, rebuilding them from history when outdated
+func (srv *server) seasonalBaselines(ctx context.Context) (*statequery.Baselines, error) {
+	srv.baselineMutex.Lock()
+	defer srv.baselineMutex.Unlock()
+
+	if srv.baselines != nil && time.Since(srv.baselines.Built) < baselineRefresh {
+		return srv.baselines, nil
+	}
+
+	log.Println("building seasonal baselines from history")
+	baselines := statequery.NewBaselines()
+	err := statequery.WalkHistory(ctx, srv.cfg.bucket, time.Now().UTC().Add(-srv.cfg.anomalyWindow), baselines.Add)
+	if err != nil {
+		return nil, err
+	}
+	srv.baselines = baselines
+	return baselines, nil
+}
+
+// Keep the last computed state in memory for read-only endpoints
+func (srv *server) remember(state *statequery.State) {
+	srv.mutex.Lock()
+	srv.last = state
+	srv.mutex.Unlock()
+}
+
+// Get the last computed state, either from memory or from the latest state dump
+func (srv *server) current(ctx context.Context) (*statequery.State, error) {
+	srv.mutex.Lock()
+	last := srv.last
+	srv.mutex.Unlock()
+	if last != nil {
+		return last, nil
+	}
+
+	// Fall back to the archive, e.g. after the instance has been restarted
+	state, err := statequery.LoadLatestState(ctx, srv.cfg.bucket)
+	if err != nil {
+		return nil, err
+	}
+	srv.remember(state)
+	return state, nil
+}
+
+// POST /scan: run the pipeline and send alerts
+func (srv *server) handleScan(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	srv.scanMutex.Lock()
+	defer srv.scanMutex.Unlock()
+
+	state, err := srv.scan(req.Context(), true)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Determine alert transitions since the previous run
+	err = srv.incidents.Track(req.Context(), state)
+	if err != nil {
+		log.Printf("failed to track incidents: %v\n", err)
+	}
+
+	// Archive the state only after notifying, so it includes the delivery results
+	notifyErr := srv.notify(req.Context(), state)
+	srv.remember(state)
+	err = state.DumpState(req.Context(), srv.cfg.bucket)
+	if err != nil {
+		err = fmt.Errorf("failed to dump state: %v", err)
+		log.Println(err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Let downstream automation react to the run
+	if srv.publisher != nil {
+		err = srv.publisher.Publish(req.Context(), state)
+		if err != nil {
+			log.Printf("failed to publish to Pub/Sub: %v\n", err)
+		}
+	}
+	if notifyErr != nil {
+		log.Println(notifyErr)
+		writeError(w, http.StatusInternalServerError, notifyErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, state)
+}
+
+// POST /: alias of /scan for existing schedulers, which trigger the service URL
+func (srv *server) handleRoot(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found: %s", req.URL.Path))
+		return
+	}
+	srv.handleScan(w, req)
+}
+
+// GET /status: return the last computed state without scanning
+func (srv *server) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	state, err := srv.current(req.Context())
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no state available: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// GET /reservations/{id}: return a single reservation from the last computed state
+func (srv *server) handleReservation(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, "/reservations/")
+	state, err := srv.current(req.Context())
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no state available: %v", err))
+		return
+	}
+
+	reservation, ok := state.Reservations[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("reservation not found: %s", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, reservation)
+}
+
+// POST /routes/test: show which routes and notifiers the reservations of a state
+// would be sent to. Uses the state in the request body, or the last computed state
+// if the body is empty.
+func (srv *server) handleRoutesTest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	state := &statequery.State{}
+	err := json.NewDecoder(req.Body).Decode(state)
+	if err == io.EOF {
+		state, err = srv.current(req.Context())
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no state available: %v", err))
+			return
+		}
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid state: %v", err))
+		return
+	}
+
+	matches := make(map[string]statequery.RouteMatch)
+	for id, reservation := range state.Reservations {
+		matches[id] = srv.cfg.router.Match(id, reservation)
+	}
+	writeJSON(w, http.StatusOK, matches)
+}
+
+// GET /healthz: liveness of the process
+func (srv *server) handleHealth(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// GET /readyz: readiness to serve scans
+func (srv *server) handleReady(w http.ResponseWriter, req *http.Request) {
+	response := healthResponse{Status: "ok", Checks: make(map[string]string)}
+	status := http.StatusOK
+
+	response.Checks["project"] = "ok"
+	if len(srv.cfg.adminProjects) == 0 {
+		response.Checks["project"] = "GOOGLE_CLOUD_PROJECT or ADMIN_PROJECTS not configured"
+		response.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+
+	response.Checks["bucket"] = "ok"
+	if srv.cfg.bucket == "" {
+		response.Checks["bucket"] = "STATE_BUCKET not configured, state will not be archived"
+	}
+
+	writeJSON(w, status, response)
+}
+
+// Encode a value as JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Encode an error as JSON response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
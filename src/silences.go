@@ -0,0 +1,175 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/statequery"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Type for requests creating a silence. The end is given either absolute or as
+// duration from the start, which defaults to now.
+type silenceRequest struct {
+	Match    statequery.Matcher  `json:"match"`
+	StartsAt *time.Time          `json:"starts_at"`
+	EndsAt   *time.Time          `json:"ends_at"`
+	Duration statequery.Duration `json:"duration"`
+	Comment  string              `json:"comment"`
+}
+
+// Type for listing silences and maintenance windows
+type silencesResponse struct {
+	Silences    []statequery.Silence `json:"silences"`
+	Maintenance []maintenanceStatus  `json:"maintenance"`
+}
+
+// Type for the current status of a maintenance window
+type maintenanceStatus struct {
+	statequery.MaintenanceWindow
+	Active bool `json:"active"`
+}
+
+// Mark reservations covered by silences or maintenance windows as suppressed. A
+// failure to load silences is logged, but does not fail the scan.
+func (srv *server) applySuppressions(ctx context.Context, state *statequery.State) {
+	var silences []statequery.Silence
+	if srv.silences != nil {
+		var err error
+		silences, err = srv.silences.List(ctx)
+		if err != nil {
+			log.Printf("failed to load silences: %v\n", err)
+		}
+	}
+	state.ApplySuppressions(silences, srv.cfg.maintenanceWindows)
+}
+
+// GET /silences: list silences and maintenance windows
+// POST /silences: create a silence
+func (srv *server) handleSilences(w http.ResponseWriter, req *http.Request) {
+	if srv.silences == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("STATE_BUCKET not configured, silences unavailable"))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		silences, err := srv.silences.List(req.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := silencesResponse{Silences: silences, Maintenance: []maintenanceStatus{}}
+		now := time.Now().UTC()
+		for i := range srv.cfg.maintenanceWindows {
+			window := &srv.cfg.maintenanceWindows[i]
+			response.Maintenance = append(response.Maintenance, maintenanceStatus{
+				MaintenanceWindow: *window,
+				Active:            window.Active(now),
+			})
+		}
+		writeJSON(w, http.StatusOK, response)
+
+	case http.MethodPost:
+		request := silenceRequest{}
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid silence: %v", err))
+			return
+		}
+
+		silence, err := request.silence(statequery.Identity(req.Context()))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		silence, err = srv.silences.Add(req.Context(), silence)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Printf("created silence %s by %s: %s\n", silence.ID, silence.CreatedBy, silence.Comment)
+		writeJSON(w, http.StatusCreated, silence)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+	}
+}
+
+// DELETE /silences/{id}: expire a silence
+func (srv *server) handleSilence(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+	if srv.silences == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("STATE_BUCKET not configured, silences unavailable"))
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, "/silences/")
+	err := srv.silences.Delete(req.Context(), id)
+	if err == statequery.ErrSilenceNotFound {
+		writeError(w, http.StatusNotFound, fmt.Errorf("silence not found: %s", id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("deleted silence %s\n", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Validate a silence request and convert it into a silence. The caller, i.e. the
+// verified identity of the request or user of the command, is recorded as creator.
+func (request silenceRequest) silence(caller string) (statequery.Silence, error) {
+	if request.Match == (statequery.Matcher{}) {
+		return statequery.Silence{}, fmt.Errorf("silence must match on at least one field, use reservation '*' to silence all")
+	}
+	if strings.TrimSpace(request.Comment) == "" {
+		return statequery.Silence{}, fmt.Errorf("silence requires a comment")
+	}
+
+	// Always attribute silences to the verified caller, so they can be audited
+	silence := statequery.Silence{
+		Match:     request.Match,
+		StartsAt:  time.Now().UTC(),
+		Comment:   request.Comment,
+		CreatedBy: caller,
+	}
+	if request.StartsAt != nil {
+		silence.StartsAt = request.StartsAt.UTC()
+	}
+
+	switch {
+	case request.EndsAt != nil:
+		silence.EndsAt = request.EndsAt.UTC()
+	case request.Duration.Duration > 0:
+		silence.EndsAt = silence.StartsAt.Add(request.Duration.Duration)
+	default:
+		return statequery.Silence{}, fmt.Errorf("silence requires either ends_at or duration")
+	}
+	if !silence.EndsAt.After(time.Now().UTC()) {
+		return statequery.Silence{}, fmt.Errorf("silence ends in the past")
+	}
+	return silence, nil
+}
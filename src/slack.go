@@ -0,0 +1,196 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"main/statequery"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum age of signed Slack requests, to prevent replays
+const slackMaxSkew = 5 * time.Minute
+
+// Mentions of users or bots within message text
+var slackMention = regexp.MustCompile(`<@[A-Z0-9]+(\|[^>]*)?>`)
+
+// Usage of the slash command and app mentions
+var slackUsage = commandUsage("/bqslots")
+
+// Type for Slack Events API callbacks
+type slackEvent struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Event     struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		User     string `json:"user"`
+		Channel  string `json:"channel"`
+		TS       string `json:"ts"`
+		ThreadTS string `json:"thread_ts"`
+	} `json:"event"`
+}
+
+// Read and verify the body of a request signed by Slack
+// (https://api.slack.com/authentication/verifying-requests-from-slack)
+func (srv *server) verifySlack(req *http.Request) ([]byte, error) {
+	secret := readSecret("SLACK_SIGNING_SECRET", "/slack-signing/secret")
+	if secret == "" {
+		return nil, fmt.Errorf("slack signing secret not configured")
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := req.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request timestamp")
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > slackMaxSkew || skew < -slackMaxSkew {
+		return nil, fmt.Errorf("request timestamp too old")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(req.Header.Get("X-Slack-Signature"))) {
+		return nil, fmt.Errorf("invalid request signature")
+	}
+	return body, nil
+}
+
+// POST /slack/commands: handle the /bqslots slash command
+func (srv *server) handleSlackCommand(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	body, err := srv.verifySlack(req)
+	if err != nil {
+		log.Printf("rejected slack request: %v\n", err)
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	text := form.Get("text")
+	user := fmt.Sprintf("slack:%s", form.Get("user_name"))
+	log.Printf("slack command from %s: %s %s\n", user, form.Get("command"), text)
+
+	// Scans take longer than Slack waits for a response, so answer them later
+	if fields := strings.Fields(text); len(fields) > 0 && fields[0] == "refresh" {
+		responseURL := form.Get("response_url")
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+			defer cancel()
+			reply := srv.command(ctx, text, user, slackUsage)
+			err := statequery.RespondSlack(ctx, responseURL, reply.Text, reply.Public)
+			if err != nil {
+				log.Printf("failed to respond to slack command: %v\n", err)
+			}
+		}()
+		writeSlackReply(w, commandReply{Text: "Scanning reservations, results will follow..."})
+		return
+	}
+
+	writeSlackReply(w, srv.command(req.Context(), text, user, slackUsage))
+}
+
+// POST /slack/events: answer app mentions like the slash command, in a thread
+func (srv *server) handleSlackEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	body, err := srv.verifySlack(req)
+	if err != nil {
+		log.Printf("rejected slack request: %v\n", err)
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	event := slackEvent{}
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Confirm the endpoint when it is configured in the Slack app
+	if event.Type == "url_verification" {
+		writeJSON(w, http.StatusOK, map[string]string{"challenge": event.Challenge})
+		return
+	}
+
+	// Slack retries events not acknowledged within 3 seconds, which are already being handled
+	if event.Type != "event_callback" || event.Event.Type != "app_mention" || req.Header.Get("X-Slack-Retry-Num") != "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	text := strings.TrimSpace(slackMention.ReplaceAllString(event.Event.Text, ""))
+	user := fmt.Sprintf("slack:%s", event.Event.User)
+	log.Printf("slack mention from %s: %s\n", user, text)
+
+	thread := event.Event.ThreadTS
+	if thread == "" {
+		thread = event.Event.TS
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+		reply := srv.command(ctx, text, user, slackUsage)
+		_, _, err := srv.slack.PostMessage(ctx, event.Event.Channel, reply.Text, thread)
+		if err != nil {
+			log.Printf("failed to reply to slack mention: %v\n", err)
+		}
+	}()
+	w.WriteHeader(http.StatusOK)
+}
+
+// Encode a reply to a slash command
+func writeSlackReply(w http.ResponseWriter, reply commandReply) {
+	responseType := "ephemeral"
+	if reply.Public {
+		responseType = "in_channel"
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"response_type": responseType,
+		"text":          reply.Text,
+	})
+}
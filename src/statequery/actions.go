@@ -0,0 +1,238 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	reservationSDK "cloud.google.com/go/bigquery/reservation/apiv1"
+	reservationPB "cloud.google.com/go/bigquery/reservation/apiv1/reservationpb"
+	fieldmaskpb "google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// Actions offered on alert messages
+const (
+	ActionAcknowledge = "ack"
+	ActionSnooze      = "snooze"
+	ActionScaleUp     = "scale"
+	// Closes the confirmation dialog of Google Chat without acting
+	ActionCancel = "cancel"
+)
+
+// Maximum length of Slack section texts
+const slackSectionLimit = 3000
+
+// Settings of the actions offered on alert messages
+type AlertActions struct {
+	// How long the snooze button silences a reservation
+	SnoozeFor time.Duration
+	// Slots added by the scale-up button, which is hidden if zero
+	ScaleSlots int64
+}
+
+// Render the message as Slack blocks, with action buttons per alerting reservation
+func (actions *AlertActions) SlackBlocks(state *State, message string) []interface{} {
+	// Cut on a rune boundary, as Slack rejects blocks with invalid UTF-8
+	if runes := []rune(message); len(runes) > slackSectionLimit {
+		message = string(runes[:slackSectionLimit-3]) + "..."
+	}
+	blocks := []interface{}{
+		map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": message},
+		},
+	}
+
+	for _, id := range sortedIDs(state) {
+		buttons := []interface{}{
+			slackButton(ActionAcknowledge, "Acknowledge", id, "primary"),
+			slackButton(ActionSnooze, fmt.Sprintf("Snooze %s", humanizeDuration(actions.SnoozeFor)), id, ""),
+		}
+		if actions.ScaleSlots > 0 {
+			// Adding slots changes billed capacity, so ask before
+			button := slackButton(ActionScaleUp, fmt.Sprintf("Add %d slots", actions.ScaleSlots), id, "danger")
+			button["confirm"] = map[string]interface{}{
+				"title":   map[string]string{"type": "plain_text", "text": "Add slots?"},
+				"text":    map[string]string{"type": "mrkdwn", "text": scaleQuestion(id, actions.ScaleSlots)},
+				"confirm": map[string]string{"type": "plain_text", "text": fmt.Sprintf("Add %d slots", actions.ScaleSlots)},
+				"deny":    map[string]string{"type": "plain_text", "text": "Cancel"},
+				"style":   "danger",
+			}
+			buttons = append(buttons, button)
+		}
+		blocks = append(blocks,
+			map[string]interface{}{
+				"type":     "context",
+				"elements": []interface{}{map[string]string{"type": "mrkdwn", "text": fmt.Sprintf("*%s*", id)}},
+			},
+			map[string]interface{}{
+				"type":     "actions",
+				"block_id": id,
+				"elements": buttons,
+			},
+		)
+	}
+	return blocks
+}
+
+// Single Slack button, carrying the reservation ID as value
+func slackButton(action string, label string, id string, style string) map[string]interface{} {
+	button := map[string]interface{}{
+		"type":      "button",
+		"action_id": action,
+		"text":      map[string]string{"type": "plain_text", "text": label},
+		"value":     id,
+	}
+	if style != "" {
+		button["style"] = style
+	}
+	return button
+}
+
+// Render the message as Google Chat card, with action buttons per alerting
+// reservation. Clicks are sent to the Chat app as CARD_CLICKED events.
+func (actions *AlertActions) ChatCard(state *State, message string) map[string]interface{} {
+	sections := []interface{}{
+		map[string]interface{}{
+			"widgets": []interface{}{
+				map[string]interface{}{"textParagraph": map[string]string{"text": message}},
+			},
+		},
+	}
+
+	for _, id := range sortedIDs(state) {
+		buttons := []interface{}{
+			chatButton(ActionAcknowledge, "Acknowledge", id, ""),
+			chatButton(ActionSnooze, fmt.Sprintf("Snooze %s", humanizeDuration(actions.SnoozeFor)), id, ""),
+		}
+		if actions.ScaleSlots > 0 {
+			// Adding slots changes billed capacity, so ask in a dialog before, see ChatScaleDialog
+			buttons = append(buttons, chatButton(ActionScaleUp, fmt.Sprintf("Add %d slots", actions.ScaleSlots), id, "OPEN_DIALOG"))
+		}
+		sections = append(sections, map[string]interface{}{
+			"header": id,
+			"widgets": []interface{}{
+				map[string]interface{}{"buttonList": map[string]interface{}{"buttons": buttons}},
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"cardId": "alert",
+		"card": map[string]interface{}{
+			"header":   map[string]string{"title": "Reservation Report"},
+			"sections": sections,
+		},
+	}
+}
+
+// Single Google Chat button, carrying the reservation ID as parameter. The
+// interaction, if set, e.g. 'OPEN_DIALOG', changes how the app is asked to respond.
+func chatButton(action string, label string, id string, interaction string) map[string]interface{} {
+	onClick := map[string]interface{}{
+		"function": action,
+		"parameters": []interface{}{
+			map[string]string{"key": "reservation", "value": id},
+		},
+	}
+	if interaction != "" {
+		onClick["interaction"] = interaction
+	}
+	return map[string]interface{}{
+		"text":    label,
+		"onClick": map[string]interface{}{"action": onClick},
+	}
+}
+
+// Render the dialog confirming to add slots to a reservation, opened by the
+// scale-up button of Google Chat cards. Its buttons are sent to the Chat app as
+// CARD_CLICKED events of the dialog.
+func ChatScaleDialog(id string, slots int64) map[string]interface{} {
+	return map[string]interface{}{
+		"header": map[string]string{"title": "Add slots?"},
+		"sections": []interface{}{
+			map[string]interface{}{
+				"widgets": []interface{}{
+					map[string]interface{}{"textParagraph": map[string]string{"text": scaleQuestion(id, slots)}},
+					map[string]interface{}{"buttonList": map[string]interface{}{"buttons": []interface{}{
+						chatButton(ActionScaleUp, fmt.Sprintf("Add %d slots", slots), id, ""),
+						chatButton(ActionCancel, "Cancel", id, ""),
+					}}},
+				},
+			},
+		},
+	}
+}
+
+// Question confirming to add slots to a reservation
+func scaleQuestion(id string, slots int64) string {
+	return fmt.Sprintf("Add %d slots to %s? This increases the billed capacity of the reservation.", slots, id)
+}
+
+// Add slots to the capacity of a reservation in its admin project, or the given one
+// if the ID is not namespaced, refusing to exceed maxSlots. Returns the new capacity.
+func ScaleReservation(ctx context.Context, project string, id string, slots int64, maxSlots int64) (int64, error) {
+	if maxSlots <= 0 {
+		return 0, fmt.Errorf("refusing to scale %s without a limit", id)
+	}
+	admin, location, reservationName, err := ParseReservationID(id)
+	if err != nil {
+		return 0, err
+	}
+	if admin != "" {
+		project = admin
+	}
+	name := fmt.Sprintf("projects/%s/locations/%s/reservations/%s", project, location, reservationName)
+
+	client, err := reservationSDK.NewClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	reservation, err := client.GetReservation(ctx, &reservationPB.GetReservationRequest{Name: name})
+	if err != nil {
+		return 0, err
+	}
+	capacity := reservation.SlotCapacity + slots
+	if capacity > maxSlots {
+		return 0, fmt.Errorf("refusing to scale %s to %d slots, exceeding the limit of %d", id, capacity, maxSlots)
+	}
+
+	log.Printf("scaling reservation %s from %d to %d slots\n", id, reservation.SlotCapacity, capacity)
+	reservation.SlotCapacity = capacity
+	updated, err := client.UpdateReservation(ctx, &reservationPB.UpdateReservationRequest{
+		Reservation: reservation,
+		UpdateMask:  &fieldmaskpb.FieldMask{Paths: []string{"slot_capacity"}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return updated.SlotCapacity, nil
+}
+
+// Reservation IDs of a state in stable order
+func sortedIDs(state *State) []string {
+	ids := make([]string, 0, len(state.Reservations))
+	for id := range state.Reservations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
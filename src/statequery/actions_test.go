@@ -0,0 +1,86 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// Actions with all buttons shown
+var testActions = &AlertActions{SnoozeFor: 90 * time.Minute, ScaleSlots: 100}
+
+// State with a single breaching reservation
+func actionState() *State {
+	return &State{Reservations: map[string]Reservation{"US.r1": {Name: "r1", ThresholdBreached: true}}}
+}
+
+func TestSlackBlocksTruncatesRunes(t *testing.T) {
+	message := strings.Repeat("█░", slackSectionLimit)
+	blocks := testActions.SlackBlocks(actionState(), message)
+
+	text := blocks[0].(map[string]interface{})["text"].(map[string]string)["text"]
+	if !utf8.ValidString(text) {
+		t.Fatal("expected truncated text to be valid UTF-8")
+	}
+	if count := utf8.RuneCountInString(text); count != slackSectionLimit {
+		t.Errorf("expected %d characters, got %d", slackSectionLimit, count)
+	}
+	if !strings.HasSuffix(text, "...") {
+		t.Errorf("expected truncated text to end with an ellipsis")
+	}
+}
+
+func TestSlackBlocksButtons(t *testing.T) {
+	blocks := testActions.SlackBlocks(actionState(), "alert")
+	buttons := blocks[2].(map[string]interface{})["elements"].([]interface{})
+	if len(buttons) != 3 {
+		t.Fatalf("expected 3 buttons, got %d", len(buttons))
+	}
+
+	snooze := buttons[1].(map[string]interface{})
+	if label := snooze["text"].(map[string]string)["text"]; label != "Snooze 1h 30m" {
+		t.Errorf("unexpected snooze label: %s", label)
+	}
+	scale := buttons[2].(map[string]interface{})
+	if _, ok := scale["confirm"]; !ok {
+		t.Error("expected the scale-up button to ask for confirmation")
+	}
+	for _, button := range buttons[:2] {
+		if _, ok := button.(map[string]interface{})["confirm"]; ok {
+			t.Errorf("expected no confirmation of %v", button)
+		}
+	}
+}
+
+func TestChatCardScaleOpensDialog(t *testing.T) {
+	card := testActions.ChatCard(actionState(), "alert")
+	sections := card["card"].(map[string]interface{})["sections"].([]interface{})
+	widgets := sections[1].(map[string]interface{})["widgets"].([]interface{})
+	buttons := widgets[0].(map[string]interface{})["buttonList"].(map[string]interface{})["buttons"].([]interface{})
+
+	interaction := func(button interface{}) interface{} {
+		action := button.(map[string]interface{})["onClick"].(map[string]interface{})["action"].(map[string]interface{})
+		return action["interaction"]
+	}
+	if interaction(buttons[2]) != "OPEN_DIALOG" {
+		t.Errorf("expected the scale-up button to open a dialog, got %v", buttons[2])
+	}
+	if interaction(buttons[0]) != nil {
+		t.Errorf("expected acknowledging without dialog, got %v", buttons[0])
+	}
+}
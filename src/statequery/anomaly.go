@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"math"
+	"time"
+)
+
+// Number of seasonal buckets, one per hour of the week
+const hoursPerWeek = 7 * 24
+
+// Lower bound for standard deviations, so perfectly flat baselines do not flag
+// every minor change as anomalous
+const minAnomalyStdDev = 0.01
+
+// Seasonal utilization baselines per reservation and hour of the week (UTC)
+type Baselines struct {
+	Built   time.Time
+	buckets map[string]*[hoursPerWeek]baselineBucket
+}
+
+// Running mean and variance of a single seasonal bucket (Welford's algorithm)
+type baselineBucket struct {
+	count int
+	mean  float64
+	m2    float64
+}
+
+// Type for the anomaly assessment of a single reservation
+type Anomaly struct {
+	Baseline float64 `json:"baseline"`
+	StdDev   float64 `json:"stddev"`
+	Score    float64 `json:"score"`
+	Samples  int     `json:"samples"`
+	Detected bool    `json:"detected"`
+}
+
+// Create empty baselines
+func NewBaselines() *Baselines {
+	return &Baselines{
+		Built:   time.Now().UTC(),
+		buckets: make(map[string]*[hoursPerWeek]baselineBucket),
+	}
+}
+
+// Add the utilization of all reservations in an archived state to the baselines
+func (baselines *Baselines) Add(state *State) {
+	hour := hourOfWeek(state.Timestamp)
+	for id, reservation := range state.Reservations {
+		buckets, ok := baselines.buckets[id]
+		if !ok {
+			buckets = &[hoursPerWeek]baselineBucket{}
+			baselines.buckets[id] = buckets
+		}
+
+		bucket := &buckets[hour]
+		value := reservation.UtilizationFactor()
+		bucket.count++
+		delta := value - bucket.mean
+		bucket.mean += delta / float64(bucket.count)
+		bucket.m2 += delta * (value - bucket.mean)
+	}
+}
+
+// Flag reservations whose utilization exceeds their seasonal baseline by more than
+// the given number of standard deviations. This replaces the fixed threshold check
+// for reservations with at least minSamples in the current hour of the week, while
+// others keep the result of the threshold check until enough history is available.
+// Slots recommended for breaches are replaced accordingly, so costs are to be
+// estimated afterwards.
+func (state *State) DetectAnomalies(baselines *Baselines, stddevs float64, minSamples int) {
+	hour := hourOfWeek(state.Timestamp)
+	for id, reservation := range state.Reservations {
+		buckets, ok := baselines.buckets[id]
+		if !ok || buckets[hour].count < minSamples {
+			continue
+		}
+
+		bucket := buckets[hour]
+		stddev := math.Max(minAnomalyStdDev, math.Sqrt(bucket.m2/float64(bucket.count)))
+		score := (reservation.UtilizationFactor() - bucket.mean) / stddev
+
+		reservation.Anomaly = &Anomaly{
+			Baseline: bucket.mean,
+			StdDev:   stddev,
+			Score:    score,
+			Samples:  bucket.count,
+			Detected: score > stddevs,
+		}
+		// Recommend the slots bringing utilization back within the baseline, rather
+		// than below the threshold
+		reservation.ThresholdBreached = reservation.Anomaly.Detected
+		limit := 0.0
+		if reservation.ThresholdBreached {
+			limit = bucket.mean + stddevs*stddev
+		}
+		reservation.recommendSlots(limit)
+		state.Reservations[id] = reservation
+	}
+}
+
+// Index of the seasonal bucket for a point in time
+func hourOfWeek(t time.Time) int {
+	t = t.UTC()
+	return int(t.Weekday())*24 + t.Hour()
+}
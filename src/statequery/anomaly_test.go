@@ -0,0 +1,87 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectAnomalies(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// Utilization of past weeks at the same hour
+		history  []float64
+		usage    float64
+		breached bool
+		detected bool
+		slots    int
+	}{
+		// Over the threshold, but usual for the hour
+		{"usual breach cleared", []float64{0.8, 0.9}, 90, false, false, 0},
+		// Below the threshold, but far above the baseline of 0.25 +- 0.05, so 50
+		// slots need to fit into 0.35 of the capacity
+		{"anomaly flagged", []float64{0.2, 0.3}, 50, true, true, 43},
+		{"within baseline", []float64{0.2, 0.3}, 30, false, false, 0},
+		{"too few samples", []float64{0.2}, 90, true, false, 13},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			baselines := NewBaselines()
+			for i, utilization := range test.history {
+				baselines.Add(&State{
+					Timestamp:    now.Add(-time.Duration(i+1) * 7 * 24 * time.Hour),
+					Reservations: map[string]Reservation{"US.r1": {Slots: 100, Utilization: utilization}},
+				})
+			}
+
+			state := &State{
+				Timestamp:    now,
+				Reservations: map[string]Reservation{"US.r1": {Slots: 100, Jobs: []Job{{Usage: test.usage}}}},
+			}
+			state.ComputeUtilization(0.8)
+			// Pretend the threshold recommendation was priced already
+			reservation := state.Reservations["US.r1"]
+			reservation.AdditionalHourlyCost = 1
+			state.Reservations["US.r1"] = reservation
+
+			state.DetectAnomalies(baselines, 2, 2)
+			reservation = state.Reservations["US.r1"]
+
+			if reservation.ThresholdBreached != test.breached {
+				t.Errorf("expected breached %v, got %v", test.breached, reservation.ThresholdBreached)
+			}
+			if detected := reservation.Anomaly != nil && reservation.Anomaly.Detected; detected != test.detected {
+				t.Errorf("expected anomaly detected %v, got %+v", test.detected, reservation.Anomaly)
+			}
+			if reservation.AdditionalSlots != test.slots {
+				t.Errorf("expected %d additional slots, got %d", test.slots, reservation.AdditionalSlots)
+			}
+			if reservation.Anomaly != nil && reservation.AdditionalHourlyCost != 0 {
+				t.Errorf("expected the cost of the replaced recommendation cleared, got %v", reservation.AdditionalHourlyCost)
+			}
+			notes := reservation.notes()
+			hasNote := false
+			for _, note := range notes {
+				hasNote = hasNote || strings.Contains(note, "additional slots needed to return below threshold")
+			}
+			if hasNote != (test.slots > 0) {
+				t.Errorf("unexpected notes %v", notes)
+			}
+		})
+	}
+}
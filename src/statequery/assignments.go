@@ -29,10 +29,12 @@ import (
 )
 
 // Retrieves assignments for each reservation and adds it to the state.
-// Reservations can be assigned to projects, folders and orgs.
+// Reservations can be assigned to projects, folders and orgs. Assignments are
+// listed in the admin project of each reservation, or the given one if the
+// reservation is not namespaced.
 //
 // WARNING: currently, only project assignments are resolved.
-func (state *State) RetrieveAssignments(ctx context.Context, project string, cache *Cache) error {
+func (state *State) RetrieveAssignments(ctx context.Context, project string, resolver HierarchyResolver) error {
 	// Create shared BQ reservations client
 	resClient, err := reservationSDK.NewClient(ctx)
 	if err != nil {
@@ -40,18 +42,17 @@ func (state *State) RetrieveAssignments(ctx context.Context, project string, cac
 	}
 	defer resClient.Close()
 
-	// Create shared resource manager client
-	manClient, err := cloudresourcemanagerSDK.NewService(ctx)
-	if err != nil {
-		return err
-	}
-
-	// Create sync for concurrent invokations
+	// Create sync for concurrent invokations, guarding writes to the state
+	var mutex sync.Mutex
 	var wg sync.WaitGroup
 	wg.Add(len(state.Reservations))
-	for _, reservation := range state.Reservations {
+	for id, reservation := range state.Reservations {
+		admin := project
+		if reservation.AdminProject != "" {
+			admin = reservation.AdminProject
+		}
 		// Create a per-reservation routine to avoid blocking on I/O during API calls
-		go retrieveAssignmentReservation(ctx, resClient, manClient, cache, project, state, reservation, &wg)
+		go retrieveAssignmentReservation(ctx, resClient, resolver, admin, state, id, reservation, &mutex, &wg)
 	}
 
 	// Synchronize routines
@@ -61,7 +62,7 @@ func (state *State) RetrieveAssignments(ctx context.Context, project string, cac
 }
 
 // Routine to retrieve assignments for a single reservation
-func retrieveAssignmentReservation(ctx context.Context, resClient *reservationSDK.Client, manClient *cloudresourcemanagerSDK.Service, cache *Cache, project string, state *State, reservation Reservation, wg *sync.WaitGroup) {
+func retrieveAssignmentReservation(ctx context.Context, resClient *reservationSDK.Client, resolver HierarchyResolver, project string, state *State, id string, reservation Reservation, mutex *sync.Mutex, wg *sync.WaitGroup) {
 	// Defer completion signal on wait group
 	defer wg.Done()
 
@@ -90,7 +91,7 @@ func retrieveAssignmentReservation(ctx context.Context, resClient *reservationSD
 		assigneeName := tokens[1]
 
 		// Retrieve all project children under an assignee
-		children, err := retrieveResourceChildren(manClient, cache, assigneeType, assigneeName)
+		children, err := resolver.Children(ctx, assigneeType, assigneeName)
 		if err != nil {
 			log.Printf("error retrieving project children: %v\n", err)
 		}
@@ -101,8 +102,9 @@ func retrieveAssignmentReservation(ctx context.Context, resClient *reservationSD
 	// Remove duplicates
 	reservation.Projects = trimDuplicates(reservation.Projects)
 
-	id := fmt.Sprintf("%s.%s", reservation.Location, reservation.Name)
+	mutex.Lock()
 	state.Reservations[id] = reservation
+	mutex.Unlock()
 }
 
 // Recursively traverses resources in Cloud Resource Manager to find all children project IDs
@@ -123,52 +125,51 @@ func retrieveResourceChildren(manClient *cloudresourcemanagerSDK.Service, cache
 	case "folders":
 		// Resource is a folder, resolve all children using Resource Manager
 
-		// Attempt cache resolution
-		result, err := cache.Get(parent)
-		if err == nil {
-			// Cache hit, return early
-			log.Printf("cache hit for key: %s\n", parent)
-			return result, nil
-		}
+		// Resolve through the cache, which coalesces concurrent walks of the same
+		// parent and serves stale results while refreshing them in the background.
+		return cache.Resolve(parent, func() ([]string, error) {
+			log.Printf("cache miss, walking resource hierarchy: %s\n", parent)
+			return listResourceChildren(manClient, cache, parent)
+		})
+	default:
+		return nil, fmt.Errorf("unexpected assignee resource type: %s", resourceType)
+	}
+}
 
-		// Cache miss
-		log.Printf("cache miss: %v\n", err)
+// Lists all project IDs under a folder or organization. Nested folders are resolved
+// through the cache, so refreshing a parent reuses the entries of its children.
+func listResourceChildren(manClient *cloudresourcemanagerSDK.Service, cache *Cache, parent string) ([]string, error) {
+	var result []string
 
-		// Resolve children of type folder
-		folders, err := manClient.Folders.List().Parent(parent).Do()
+	// Resolve children of type folder
+	folders, err := manClient.Folders.List().Parent(parent).Do()
+	if err != nil {
+		return nil, err
+	}
+	for _, folder := range folders.Folders {
+		tokens := strings.Split(folder.Name, "/")
+		folderName := tokens[1]
+		children, err := retrieveResourceChildren(manClient, cache, "folders", folderName)
 		if err != nil {
 			return nil, err
 		}
-		for _, folder := range folders.Folders {
-			tokens := strings.Split(folder.Name, "/")
-			folderName := tokens[1]
-			children, err := retrieveResourceChildren(manClient, cache, "folders", folderName)
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, children...)
-		}
+		result = append(result, children...)
+	}
 
-		// Resolve children of type project
-		projects, err := manClient.Projects.List().Parent(parent).Do()
+	// Resolve children of type project
+	projects, err := manClient.Projects.List().Parent(parent).Do()
+	if err != nil {
+		return nil, err
+	}
+	for _, project := range projects.Projects {
+		children, err := retrieveResourceChildren(manClient, cache, "projects", project.ProjectId)
 		if err != nil {
 			return nil, err
 		}
-		for _, project := range projects.Projects {
-			children, err := retrieveResourceChildren(manClient, cache, "projects", project.ProjectId)
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, children...)
-		}
-
-		// Update cache
-		cache.Add(parent, result)
-
-		return result, nil
-	default:
-		return nil, fmt.Errorf("unexpected assignee resource type: %s", resourceType)
+		result = append(result, children...)
 	}
+
+	return result, nil
 }
 
 // Trim duplicate strings from a slice
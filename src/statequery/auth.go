@@ -0,0 +1,126 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+)
+
+// Function validating the signature, expiry and audience of an ID token
+type TokenValidator func(ctx context.Context, token string, audience string) (*idtoken.Payload, error)
+
+// Context key for the email of the authenticated caller
+type identityKey struct{}
+
+// Verifies Google-signed OIDC ID tokens, e.g. as sent by Cloud Scheduler
+type TokenVerifier struct {
+	audience string
+	emails   map[string]bool
+	validate TokenValidator
+}
+
+// Create a verifier for tokens issued to the given audience. If emails is not empty,
+// only tokens of these (service account) identities are accepted.
+// Google's signing keys are fetched once and cached according to their HTTP caching
+// headers. Tests can substitute validate to verify tokens offline.
+func NewTokenVerifier(ctx context.Context, audience string, emails []string, validate TokenValidator) (*TokenVerifier, error) {
+	if validate == nil {
+		validator, err := idtoken.NewValidator(ctx)
+		if err != nil {
+			return nil, err
+		}
+		validate = validator.Validate
+	}
+
+	verifier := &TokenVerifier{
+		audience: audience,
+		emails:   make(map[string]bool),
+		validate: validate,
+	}
+	for _, email := range emails {
+		verifier.emails[email] = true
+	}
+	return verifier, nil
+}
+
+// Verify a raw ID token and return the email of its subject
+func (verifier *TokenVerifier) Verify(ctx context.Context, token string) (string, error) {
+	payload, err := verifier.validate(ctx, token, verifier.audience)
+	if err != nil {
+		return "", err
+	}
+
+	// Signature and audience are checked by the validator, the issuer is not
+	if payload.Issuer != "accounts.google.com" && payload.Issuer != "https://accounts.google.com" {
+		return "", fmt.Errorf("unexpected token issuer: %s", payload.Issuer)
+	}
+
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if email == "" || !verified {
+		return "", fmt.Errorf("token without verified email")
+	}
+	if len(verifier.emails) > 0 && !verifier.emails[email] {
+		return "", fmt.Errorf("identity not allowed: %s", email)
+	}
+	return email, nil
+}
+
+// Wrap a handler to reject requests without a valid bearer token before any work is
+// done. A nil verifier disables authentication.
+func (verifier *TokenVerifier) Require(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if verifier == nil {
+			next(w, req)
+			return
+		}
+
+		header := req.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header || token == "" {
+			unauthorized(w, "missing bearer token")
+			return
+		}
+
+		email, err := verifier.Verify(req.Context(), token)
+		if err != nil {
+			log.Printf("rejected request: %v\n", err)
+			unauthorized(w, "invalid bearer token")
+			return
+		}
+		log.Printf("authenticated request from %s\n", email)
+		next(w, req.WithContext(context.WithValue(req.Context(), identityKey{}, email)))
+	}
+}
+
+// Respond with status 401 and the error as JSON, like other errors of the service
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// Get the email of the authenticated caller, empty if authentication is disabled
+func Identity(ctx context.Context) string {
+	email, _ := ctx.Value(identityKey{}).(string)
+	return email
+}
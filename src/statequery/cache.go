@@ -15,64 +15,313 @@
 package statequery
 
 import (
+	"container/list"
+	"context"
 	"fmt"
+	"log"
 	"sync"
 	"time"
 )
 
 // Cache type to hold frequently requested responses from the Resource Manager API.
+// Concurrent lookups of the same key are coalesced into a single fetch, stale items
+// are served while being refreshed in the background and the number of items is
+// bounded by evicting the least recently used ones. Optionally, the cache is
+// persisted to a CacheStore to survive instance restarts.
 type Cache struct {
-	mutex  sync.Mutex
-	maxTTL time.Duration
-	items  map[string]*cacheItem
+	mutex      sync.Mutex
+	maxTTL     time.Duration
+	maxEntries int
+	items      map[string]*list.Element
+	lru        *list.List
+	calls      map[string]*cacheCall
+	stats      CacheStats
+	store      CacheStore
+	version    int64
+	dirty      bool
 }
 
 // Single cacheItem, timestamped to control freshness
 type cacheItem struct {
+	key      string
 	updated  time.Time
 	projects []string
 }
 
+// Fetch in flight for a single key, shared by all concurrent callers
+type cacheCall struct {
+	wg       sync.WaitGroup
+	projects []string
+	err      error
+}
+
+// Counters on cache effectiveness, exposed on the state
+type CacheStats struct {
+	Entries       int    `json:"entries"`
+	Hits          uint64 `json:"hits"`
+	StaleHits     uint64 `json:"stale_hits"`
+	Misses        uint64 `json:"misses"`
+	Coalesced     uint64 `json:"coalesced"`
+	Refreshes     uint64 `json:"refreshes"`
+	RefreshErrors uint64 `json:"refresh_errors"`
+	Evictions     uint64 `json:"evictions"`
+	Persists      uint64 `json:"persists"`
+	Conflicts     uint64 `json:"conflicts"`
+}
+
 // Add an item to the cache
 func (cache *Cache) Add(key string, projects []string) {
 	cache.mutex.Lock()
+	cache.add(key, projects, time.Now().UTC())
+	cache.mutex.Unlock()
+}
+
+// Insert or update an item and evict least recently used items beyond the bound.
+// Callers must hold the mutex.
+func (cache *Cache) add(key string, projects []string, updated time.Time) {
+	cache.dirty = true
 
-	cache.items[key] = &cacheItem{
-		updated:  time.Now().UTC(),
-		projects: projects,
+	element, ok := cache.items[key]
+	if ok {
+		item := element.Value.(*cacheItem)
+		item.updated = updated
+		item.projects = projects
+		cache.lru.MoveToFront(element)
+	} else {
+		cache.items[key] = cache.lru.PushFront(&cacheItem{
+			key:      key,
+			updated:  updated,
+			projects: projects,
+		})
 	}
 
-	cache.mutex.Unlock()
+	// Enforce max entries, if configured
+	for cache.maxEntries > 0 && cache.lru.Len() > cache.maxEntries {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.items, oldest.Value.(*cacheItem).key)
+		cache.stats.Evictions++
+	}
 }
 
 // Get an item from the cache. Will return items if available and fresh enough.
 func (cache *Cache) Get(key string) ([]string, error) {
 	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
 
-	item, ok := cache.items[key]
+	element, ok := cache.items[key]
 	if !ok {
 		// Cache miss
-		cache.mutex.Unlock()
 		return nil, fmt.Errorf("key not in cache: %s", key)
 	}
 	// Cache hit
+	item := element.Value.(*cacheItem)
+	cache.lru.MoveToFront(element)
 
 	// Check cache freshness
-	diff := time.Now().UTC().Sub(item.updated)
-	if diff >= cache.maxTTL {
-		// Cache is stale
-		delete(cache.items, key)
-		cache.mutex.Unlock()
+	if time.Now().UTC().Sub(item.updated) >= cache.maxTTL {
+		// Cache is stale, keep serving it through Resolve until refreshed
 		return nil, fmt.Errorf("cache appears stale for key: %s", key)
 	}
 
 	// Cache item OK
+	return item.projects, nil
+}
+
+// Resolve an item through the cache, falling back to fetch on a miss.
+// Fresh items are returned directly. Stale items are returned as well, while a
+// single background refresh is started for the key. Missing items are fetched
+// once, with concurrent callers for the same key waiting on the same fetch.
+func (cache *Cache) Resolve(key string, fetch func() ([]string, error)) ([]string, error) {
+	cache.mutex.Lock()
+
+	element, ok := cache.items[key]
+	if ok {
+		item := element.Value.(*cacheItem)
+		cache.lru.MoveToFront(element)
+
+		if time.Now().UTC().Sub(item.updated) < cache.maxTTL {
+			// Cache hit
+			cache.stats.Hits++
+			cache.mutex.Unlock()
+			return item.projects, nil
+		}
+
+		// Cache is stale, serve it and refresh asynchronously
+		cache.stats.StaleHits++
+		if _, inflight := cache.calls[key]; !inflight {
+			log.Printf("cache stale, refreshing in background: %s\n", key)
+			cache.stats.Refreshes++
+			call := cache.startCall(key)
+			go cache.runCall(key, call, fetch, true)
+		}
+		cache.mutex.Unlock()
+		return item.projects, nil
+	}
+
+	if call, inflight := cache.calls[key]; inflight {
+		// Another caller is already fetching this key, wait for its result
+		cache.stats.Coalesced++
+		cache.mutex.Unlock()
+		call.wg.Wait()
+		return call.projects, call.err
+	}
+
+	// Cache miss, counted once for the caller fetching the key
+	cache.stats.Misses++
+	call := cache.startCall(key)
+	cache.mutex.Unlock()
+
+	cache.runCall(key, call, fetch, false)
+	return call.projects, call.err
+}
+
+// Register a new fetch in flight. Callers must hold the mutex.
+func (cache *Cache) startCall(key string) *cacheCall {
+	call := &cacheCall{}
+	call.wg.Add(1)
+	cache.calls[key] = call
+	return call
+}
+
+// Execute a fetch, store its result and release all waiting callers
+func (cache *Cache) runCall(key string, call *cacheCall, fetch func() ([]string, error), refresh bool) {
+	call.projects, call.err = fetch()
+
+	cache.mutex.Lock()
+	if call.err == nil {
+		cache.add(key, call.projects, time.Now().UTC())
+	} else if refresh {
+		log.Printf("failed to refresh cache for key %s: %v\n", key, call.err)
+		cache.stats.RefreshErrors++
+	}
+	delete(cache.calls, key)
+	cache.mutex.Unlock()
+
+	call.wg.Done()
+
+	// Persist results of background refreshes, as no scan is waiting on them
+	if refresh && call.err == nil {
+		err := cache.Persist(context.Background())
+		if err != nil {
+			log.Printf("failed to persist cache: %v\n", err)
+		}
+	}
+}
+
+// Get a snapshot of the cache statistics
+func (cache *Cache) Stats() CacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	stats := cache.stats
+	stats.Entries = cache.lru.Len()
+	return stats
+}
+
+// Attach a backing store to the cache and load its contents. Loaded items keep
+// their original timestamps, so stale items are refreshed on first use.
+func (cache *Cache) Attach(ctx context.Context, store CacheStore) error {
+	snapshot, version, err := store.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.store = store
+	cache.version = version
+	cache.merge(snapshot)
+	cache.dirty = false
+
+	log.Printf("loaded %d cache entries from store (version %d)\n", len(snapshot.Items), version)
+	return nil
+}
+
+// Write the cache contents to the backing store, if attached and changed since the
+// last write. On conflicts with other instances, their newer items are merged and
+// the write is retried.
+func (cache *Cache) Persist(ctx context.Context) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		cache.mutex.Lock()
+		if cache.store == nil || !cache.dirty {
+			cache.mutex.Unlock()
+			return nil
+		}
+		store := cache.store
+		version := cache.version
+		snapshot := cache.snapshot()
+		cache.dirty = false
+		cache.mutex.Unlock()
+
+		updated, err := store.Save(ctx, snapshot, version)
+		if err == ErrVersionConflict {
+			// Another instance has written in between, merge its items and retry
+			remote, remoteVersion, err := store.Load(ctx)
+			if err != nil {
+				cache.markDirty()
+				return err
+			}
+			cache.mutex.Lock()
+			cache.stats.Conflicts++
+			cache.merge(remote)
+			cache.version = remoteVersion
+			cache.dirty = true
+			cache.mutex.Unlock()
+			continue
+		}
+		if err != nil {
+			cache.markDirty()
+			return err
+		}
+
+		cache.mutex.Lock()
+		cache.version = updated
+		cache.stats.Persists++
+		cache.mutex.Unlock()
+		return nil
+	}
+	return fmt.Errorf("giving up persisting cache after repeated conflicts")
+}
+
+// Flag the cache as changed, so the next Persist writes it
+func (cache *Cache) markDirty() {
+	cache.mutex.Lock()
+	cache.dirty = true
 	cache.mutex.Unlock()
-	return cache.items[key].projects, nil
 }
 
-// Initialize and configure cache
-func (cache *Cache) Initialize(maxTTL time.Duration) {
-	cache.items = make(map[string]*cacheItem)
+// Serialize all items. Callers must hold the mutex.
+func (cache *Cache) snapshot() *CacheSnapshot {
+	snapshot := &CacheSnapshot{Items: make(map[string]CacheEntry, len(cache.items))}
+	for key, element := range cache.items {
+		item := element.Value.(*cacheItem)
+		snapshot.Items[key] = CacheEntry{
+			Updated:  item.updated,
+			Projects: item.projects,
+		}
+	}
+	return snapshot
+}
+
+// Merge items from a snapshot, keeping whichever version of an item is newer.
+// Callers must hold the mutex.
+func (cache *Cache) merge(snapshot *CacheSnapshot) {
+	for key, entry := range snapshot.Items {
+		element, ok := cache.items[key]
+		if ok && !entry.Updated.After(element.Value.(*cacheItem).updated) {
+			continue
+		}
+		cache.add(key, entry.Projects, entry.Updated)
+	}
+}
+
+// Initialize and configure cache. A maxEntries value of zero disables the bound.
+func (cache *Cache) Initialize(maxTTL time.Duration, maxEntries int) {
+	cache.items = make(map[string]*list.Element)
+	cache.lru = list.New()
+	cache.calls = make(map[string]*cacheCall)
 	cache.maxTTL = maxTTL
+	cache.maxEntries = maxEntries
 }
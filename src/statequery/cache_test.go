@@ -0,0 +1,261 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Resolver counting its fetches, which block until released if a release
+// channel is set
+type countingResolver struct {
+	calls    int32
+	release  chan struct{}
+	projects []string
+	err      error
+}
+
+// Fetch function passed to Cache.Resolve
+func (resolver *countingResolver) fetch() ([]string, error) {
+	atomic.AddInt32(&resolver.calls, 1)
+	if resolver.release != nil {
+		<-resolver.release
+	}
+	return resolver.projects, resolver.err
+}
+
+// Number of fetches so far
+func (resolver *countingResolver) count() int {
+	return int(atomic.LoadInt32(&resolver.calls))
+}
+
+// Create a cache for tests
+func testCache(maxTTL time.Duration, maxEntries int) *Cache {
+	cache := &Cache{}
+	cache.Initialize(maxTTL, maxEntries)
+	return cache
+}
+
+// Wait until the condition holds, failing the test after a second
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheCoalescesMisses(t *testing.T) {
+	tests := []struct {
+		name    string
+		callers int
+		err     error
+	}{
+		{"single caller", 1, nil},
+		{"concurrent callers", 20, nil},
+		{"concurrent callers with error", 5, errors.New("permission denied")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := testCache(time.Hour, 0)
+			resolver := &countingResolver{release: make(chan struct{}), projects: []string{"p1", "p2"}, err: test.err}
+
+			var wg sync.WaitGroup
+			results := make([][]string, test.callers)
+			errs := make([]error, test.callers)
+			for i := 0; i < test.callers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					results[i], errs[i] = cache.Resolve("folders/1", resolver.fetch)
+				}(i)
+			}
+			// Release the fetch only once all other callers wait on it
+			waitFor(t, "callers to coalesce", func() bool {
+				return resolver.count() == 1 && cache.Stats().Coalesced == uint64(test.callers-1)
+			})
+			close(resolver.release)
+			wg.Wait()
+
+			if resolver.count() != 1 {
+				t.Errorf("expected a single fetch, got %d", resolver.count())
+			}
+			stats := cache.Stats()
+			if stats.Misses != 1 || stats.Coalesced != uint64(test.callers-1) {
+				t.Errorf("expected 1 miss and %d coalesced, got %+v", test.callers-1, stats)
+			}
+			for i := range results {
+				if errs[i] != test.err {
+					t.Errorf("caller %d: expected error %v, got %v", i, test.err, errs[i])
+				}
+				if test.err == nil && !reflect.DeepEqual(results[i], resolver.projects) {
+					t.Errorf("caller %d: unexpected projects %v", i, results[i])
+				}
+			}
+			if _, err := cache.Get("folders/1"); (err == nil) != (test.err == nil) {
+				t.Errorf("expected only successful fetches to be cached, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		// Keys added, or resolved if prefixed with '>', in order
+		steps     []string
+		remaining []string
+		evictions uint64
+	}{
+		{"unbounded", 0, []string{"a", "b", "c"}, []string{"a", "b", "c"}, 0},
+		{"oldest first", 2, []string{"a", "b", "c"}, []string{"b", "c"}, 1},
+		{"resolve refreshes recency", 2, []string{"a", "b", ">a", "c"}, []string{"a", "c"}, 1},
+		{"update refreshes recency", 2, []string{"a", "b", "a", "c", "d"}, []string{"c", "d"}, 2},
+		{"single entry", 1, []string{"a", "b", "c"}, []string{"c"}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := testCache(time.Hour, test.maxEntries)
+			resolver := &countingResolver{}
+			for _, step := range test.steps {
+				if step[0] == '>' {
+					cache.Resolve(step[1:], resolver.fetch)
+					continue
+				}
+				cache.Add(step, []string{step})
+			}
+
+			var remaining []string
+			for element := cache.lru.Back(); element != nil; element = element.Prev() {
+				remaining = append(remaining, element.Value.(*cacheItem).key)
+			}
+			if !reflect.DeepEqual(remaining, test.remaining) {
+				t.Errorf("expected %v from least to most recently used, got %v", test.remaining, remaining)
+			}
+			if stats := cache.Stats(); stats.Evictions != test.evictions || stats.Entries != len(test.remaining) {
+				t.Errorf("expected %d evictions of %d entries, got %+v", test.evictions, len(test.remaining), stats)
+			}
+			if resolver.count() != 0 {
+				t.Errorf("expected no fetches, got %d", resolver.count())
+			}
+		})
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	tests := []struct {
+		name  string
+		age   time.Duration
+		fresh bool
+	}{
+		{"fresh", time.Minute, true},
+		{"just before expiry", time.Hour - time.Second, true},
+		{"at expiry", time.Hour, false},
+		{"expired", 2 * time.Hour, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := testCache(time.Hour, 0)
+			cache.add("folders/1", []string{"old"}, time.Now().UTC().Add(-test.age))
+
+			_, err := cache.Get("folders/1")
+			if (err == nil) != test.fresh {
+				t.Errorf("expected fresh %v, got error %v", test.fresh, err)
+			}
+
+			// Resolve serves the item either way, only stale ones are refreshed
+			resolver := &countingResolver{projects: []string{"new"}}
+			projects, err := cache.Resolve("folders/1", resolver.fetch)
+			if err != nil || !reflect.DeepEqual(projects, []string{"old"}) {
+				t.Errorf("expected the cached item, got %v, %v", projects, err)
+			}
+			stats := cache.Stats()
+			if test.fresh && (stats.Hits != 1 || stats.StaleHits != 0 || stats.Refreshes != 0) {
+				t.Errorf("expected a fresh hit, got %+v", stats)
+			}
+			if !test.fresh && (stats.Hits != 0 || stats.StaleHits != 1 || stats.Refreshes != 1) {
+				t.Errorf("expected a stale hit and refresh, got %+v", stats)
+			}
+			if !test.fresh {
+				waitFor(t, "refresh", func() bool {
+					_, err := cache.Get("folders/1")
+					return err == nil
+				})
+			}
+		})
+	}
+}
+
+func TestCacheStaleRefresh(t *testing.T) {
+	tests := []struct {
+		name    string
+		callers int
+		err     error
+		// Projects served once the refresh completed
+		served []string
+	}{
+		{"refreshed", 1, nil, []string{"new"}},
+		{"single refresh for concurrent callers", 10, nil, []string{"new"}},
+		{"failed refresh keeps stale item", 3, errors.New("unavailable"), []string{"old"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := testCache(time.Hour, 0)
+			cache.add("folders/1", []string{"old"}, time.Now().UTC().Add(-2*time.Hour))
+			resolver := &countingResolver{release: make(chan struct{}), projects: []string{"new"}, err: test.err}
+
+			// All callers are served the stale item right away
+			for i := 0; i < test.callers; i++ {
+				projects, err := cache.Resolve("folders/1", resolver.fetch)
+				if err != nil || !reflect.DeepEqual(projects, []string{"old"}) {
+					t.Fatalf("expected the stale item, got %v, %v", projects, err)
+				}
+			}
+			close(resolver.release)
+			waitFor(t, "refresh", func() bool {
+				cache.mutex.Lock()
+				defer cache.mutex.Unlock()
+				return len(cache.calls) == 0
+			})
+
+			if resolver.count() != 1 {
+				t.Errorf("expected a single refresh, got %d", resolver.count())
+			}
+			stats := cache.Stats()
+			if stats.StaleHits != uint64(test.callers) || stats.Refreshes != 1 || stats.Misses != 0 {
+				t.Errorf("expected %d stale hits and 1 refresh, got %+v", test.callers, stats)
+			}
+			if test.err != nil && stats.RefreshErrors != 1 {
+				t.Errorf("expected a refresh error, got %+v", stats)
+			}
+
+			cache.mutex.Lock()
+			served := cache.items["folders/1"].Value.(*cacheItem).projects
+			cache.mutex.Unlock()
+			if !reflect.DeepEqual(served, test.served) {
+				t.Errorf("expected %v after the refresh, got %v", test.served, served)
+			}
+		})
+	}
+}
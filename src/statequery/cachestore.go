@@ -0,0 +1,177 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	storageSDK "cloud.google.com/go/storage"
+)
+
+// Serialized form of the cache contents
+type CacheSnapshot struct {
+	Items map[string]CacheEntry `json:"items"`
+}
+
+// Serialized form of a single cache item
+type CacheEntry struct {
+	Updated  time.Time `json:"updated"`
+	Projects []string  `json:"projects"`
+}
+
+// Backing store to persist the cache across instances. Snapshots are versioned,
+// so concurrent writers detect each other instead of overwriting their changes.
+type CacheStore interface {
+	// Load the latest snapshot and its version. Returns an empty snapshot and
+	// version zero if nothing has been stored yet.
+	Load(ctx context.Context) (*CacheSnapshot, int64, error)
+	// Save a snapshot if the stored version still matches and return the new
+	// version. Returns ErrVersionConflict otherwise.
+	Save(ctx context.Context, snapshot *CacheSnapshot, version int64) (int64, error)
+}
+
+// Create a cache store from a URI. Supports GCS objects (gs://bucket/object) and
+// local file paths.
+func NewCacheStore(ctx context.Context, uri string) (CacheStore, error) {
+	if strings.HasPrefix(uri, "gs://") {
+		tokens := strings.SplitN(strings.TrimPrefix(uri, "gs://"), "/", 2)
+		if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+			return nil, fmt.Errorf("invalid GCS cache store URI: %s", uri)
+		}
+		client, err := storageSDK.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &GCSCacheStore{client: client, bucket: tokens[0], object: tokens[1]}, nil
+	}
+	return &FileCacheStore{Path: uri}, nil
+}
+
+// Cache store backed by a GCS object, versioned by the object generation
+type GCSCacheStore struct {
+	client *storageSDK.Client
+	bucket string
+	object string
+}
+
+// Load the cache snapshot from GCS
+func (store *GCSCacheStore) Load(ctx context.Context) (*CacheSnapshot, int64, error) {
+	snapshot := &CacheSnapshot{}
+	generation, err := readObject(ctx, store.client, store.bucket, store.object, snapshot)
+	if err != nil {
+		return nil, 0, err
+	}
+	return snapshot, generation, nil
+}
+
+// Save the cache snapshot to GCS, conditional on the object generation
+func (store *GCSCacheStore) Save(ctx context.Context, snapshot *CacheSnapshot, version int64) (int64, error) {
+	return writeObject(ctx, store.client, store.bucket, store.object, snapshot, version)
+}
+
+// Cache store backed by a local file, versioned by a counter kept in the file
+type FileCacheStore struct {
+	Path string
+}
+
+// On-disk format of the file cache store
+type fileCacheDocument struct {
+	Version  int64          `json:"version"`
+	Snapshot *CacheSnapshot `json:"snapshot"`
+}
+
+// Load the cache snapshot from the local file
+func (store *FileCacheStore) Load(ctx context.Context) (*CacheSnapshot, int64, error) {
+	data, err := os.ReadFile(store.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &CacheSnapshot{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	document := fileCacheDocument{}
+	err = json.Unmarshal(data, &document)
+	if err != nil {
+		return nil, 0, err
+	}
+	if document.Snapshot == nil {
+		document.Snapshot = &CacheSnapshot{}
+	}
+	return document.Snapshot, document.Version, nil
+}
+
+// Save the cache snapshot to the local file, conditional on the stored version.
+// A lock file guards the compare-and-swap against other processes sharing the disk.
+func (store *FileCacheStore) Save(ctx context.Context, snapshot *CacheSnapshot, version int64) (int64, error) {
+	lock := store.Path + ".lock"
+
+	// Break locks left behind by crashed writers
+	info, err := os.Stat(lock)
+	if err == nil && time.Since(info.ModTime()) > time.Minute {
+		os.Remove(lock)
+	}
+
+	file, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return 0, ErrVersionConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+	file.Close()
+	defer os.Remove(lock)
+
+	// Compare stored version before writing
+	_, current, err := store.Load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if current != version {
+		return 0, ErrVersionConflict
+	}
+
+	data, err := json.Marshal(fileCacheDocument{Version: version + 1, Snapshot: snapshot})
+	if err != nil {
+		return 0, err
+	}
+
+	// Write to a temporary file and rename, so readers never see partial writes
+	temp, err := os.CreateTemp(filepath.Dir(store.Path), filepath.Base(store.Path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Close()
+	} else {
+		temp.Close()
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), store.Path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return 0, err
+	}
+	return version + 1, nil
+}
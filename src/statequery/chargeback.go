@@ -0,0 +1,367 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	storageSDK "cloud.google.com/go/storage"
+	bigquerySDK "google.golang.org/api/bigquery/v2"
+)
+
+// Layout of chargeback dates
+const chargebackDate = "2006-01-02"
+
+// Interval between polls of chargeback load jobs
+const chargebackPollInterval = 2 * time.Second
+
+// Slot-hours consumed on a reservation during a single day (UTC)
+type Chargeback struct {
+	Date string `json:"date"`
+	// Key of the job label breaking down usage within projects
+	LabelKey string          `json:"label_key,omitempty"`
+	Rows     []ChargebackRow `json:"rows"`
+}
+
+// Slot-hours of one project and label value on a reservation. Idle capacity is
+// allocated in proportion to the used slot-hours, so the slot-hours of all rows of
+// a reservation add up to its capacity. Idle capacity of reservations without any
+// usage is reported on a row without project.
+type ChargebackRow struct {
+	Date          string  `json:"date"`
+	Reservation   string  `json:"reservation"`
+	Project       string  `json:"project"`
+	Folder        string  `json:"folder"`
+	Label         string  `json:"label"`
+	UsedSlotHours float64 `json:"used_slot_hours"`
+	IdleSlotHours float64 `json:"idle_slot_hours"`
+	SlotHours     float64 `json:"slot_hours"`
+}
+
+// Consumer of a reservation, as charged back
+type chargebackKey struct {
+	project string
+	label   string
+}
+
+// Usage of a reservation in a single archived state
+type chargebackSample struct {
+	timestamp time.Time
+	slots     float64
+	usage     map[chargebackKey]float64
+}
+
+// Integrate the job usage of the states archived in the bucket on the given day
+// into slot-hours per reservation, project and value of the label key. Like for
+// digests, each state is taken to represent the time until the next one, bounded
+// by maxSampleGap, so the last state of the previous day covers the start of the
+// day. Projects are charged to their parent folder or organization, as far as the
+// resolver can resolve them.
+func BuildChargeback(ctx context.Context, bucket string, date time.Time, label string, resolver HierarchyResolver) (*Chargeback, error) {
+	from := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	samples := make(map[string][]chargebackSample)
+	err := WalkHistory(ctx, bucket, from.Add(-maxSampleGap), func(state *State) {
+		if !state.Timestamp.Before(to) {
+			return
+		}
+		for id, reservation := range state.Reservations {
+			sample := chargebackSample{
+				timestamp: state.Timestamp,
+				slots:     reservation.Slots,
+				usage:     make(map[chargebackKey]float64),
+			}
+			for _, job := range reservation.Jobs {
+				project := job.Project
+				if project == "" {
+					project = strings.SplitN(job.Name, ":", 2)[0]
+				}
+				sample.usage[chargebackKey{project: project, label: job.Labels[label]}] += job.Usage
+			}
+			samples[id] = append(samples[id], sample)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	chargeback := &Chargeback{Date: from.Format(chargebackDate), LabelKey: label}
+	for id, series := range samples {
+		chargeback.Rows = append(chargeback.Rows, chargebackRows(chargeback.Date, id, series, from, to)...)
+	}
+	chargebackFolders(ctx, chargeback.Rows, resolver)
+	sort.Slice(chargeback.Rows, func(i, j int) bool {
+		a, b := chargeback.Rows[i], chargeback.Rows[j]
+		if a.Reservation != b.Reservation {
+			return a.Reservation < b.Reservation
+		}
+		if a.Project != b.Project {
+			return a.Project < b.Project
+		}
+		return a.Label < b.Label
+	})
+	return chargeback, nil
+}
+
+// Compute the rows of a reservation from its samples, counting only the part of
+// each sample's interval within the day
+func chargebackRows(date string, id string, series []chargebackSample, from time.Time, to time.Time) []ChargebackRow {
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].timestamp.Before(series[j].timestamp)
+	})
+
+	covered := 0.0
+	capacity := 0.0
+	used := 0.0
+	usage := make(map[chargebackKey]float64)
+	for i, sample := range series {
+		end := to
+		if i+1 < len(series) {
+			end = series[i+1].timestamp
+		}
+		if limit := sample.timestamp.Add(maxSampleGap); end.After(limit) {
+			end = limit
+		}
+		start := sample.timestamp
+		if start.Before(from) {
+			start = from
+		}
+		if !end.After(start) {
+			continue
+		}
+		hours := end.Sub(start).Hours()
+		covered += hours
+		capacity += sample.slots * hours
+		for key, slots := range sample.usage {
+			usage[key] += slots * hours
+			used += slots * hours
+		}
+	}
+
+	// Reservations only seen before the day are not charged
+	if covered == 0 {
+		return nil
+	}
+
+	// Usage beyond the capacity, e.g. of idle slots borrowed from other
+	// reservations, leaves nothing to allocate
+	idle := math.Max(0, capacity-used)
+	if used == 0 {
+		return []ChargebackRow{{Date: date, Reservation: id, IdleSlotHours: idle, SlotHours: idle}}
+	}
+
+	rows := make([]ChargebackRow, 0, len(usage))
+	for key, slotHours := range usage {
+		share := idle * slotHours / used
+		rows = append(rows, ChargebackRow{
+			Date:          date,
+			Reservation:   id,
+			Project:       key.project,
+			Label:         key.label,
+			UsedSlotHours: slotHours,
+			IdleSlotHours: share,
+			SlotHours:     slotHours + share,
+		})
+	}
+	return rows
+}
+
+// Fill in the folder of rows by resolving the parent of each project once.
+// Projects that cannot be resolved are left without folder.
+func chargebackFolders(ctx context.Context, rows []ChargebackRow, resolver HierarchyResolver) {
+	if resolver == nil {
+		return
+	}
+	folders := make(map[string]string)
+	for i := range rows {
+		project := rows[i].Project
+		if project == "" {
+			continue
+		}
+		folder, ok := folders[project]
+		if !ok {
+			var err error
+			folder, err = resolver.Parent(ctx, project)
+			if err != nil {
+				log.Printf("failed to resolve parent of project %s: %v\n", project, err)
+			}
+			folders[project] = folder
+		}
+		rows[i].Folder = folder
+	}
+}
+
+// Encode the rows as CSV with a header line
+func (chargeback *Chargeback) CSV() ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	records := [][]string{{"date", "reservation", "project", "folder", "label", "used_slot_hours", "idle_slot_hours", "slot_hours"}}
+	for _, row := range chargeback.Rows {
+		records = append(records, []string{
+			row.Date,
+			row.Reservation,
+			row.Project,
+			row.Folder,
+			row.Label,
+			strconv.FormatFloat(row.UsedSlotHours, 'f', 3, 64),
+			strconv.FormatFloat(row.IdleSlotHours, 'f', 3, 64),
+			strconv.FormatFloat(row.SlotHours, 'f', 3, 64),
+		})
+	}
+	err := writer.WriteAll(records)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Encode the rows as newline-delimited JSON, as loaded by BigQuery
+func (chargeback *Chargeback) JSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, row := range chargeback.Rows {
+		err := encoder.Encode(row)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// Names of the CSV and JSON objects of the chargeback in the bucket
+func (chargeback *Chargeback) Objects() []string {
+	return []string{
+		fmt.Sprintf("chargeback/%s.csv", chargeback.Date),
+		fmt.Sprintf("chargeback/%s.json", chargeback.Date),
+	}
+}
+
+// Write the chargeback to the bucket as CSV and JSON, replacing earlier exports
+// of the same day
+func (chargeback *Chargeback) Export(ctx context.Context, bucket string) error {
+	client, err := storageSDK.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	encoded := make([][]byte, 2)
+	encoded[0], err = chargeback.CSV()
+	if err != nil {
+		return err
+	}
+	encoded[1], err = chargeback.JSON()
+	if err != nil {
+		return err
+	}
+	contentTypes := []string{"text/csv", "application/x-ndjson"}
+
+	for i, object := range chargeback.Objects() {
+		writer := client.Bucket(bucket).Object(object).NewWriter(ctx)
+		writer.ContentType = contentTypes[i]
+		_, err = writer.Write(encoded[i])
+		if err != nil {
+			writer.Close()
+			return err
+		}
+		err = writer.Close()
+		if err != nil {
+			return err
+		}
+		log.Printf("exported chargeback to gs://%s/%s\n", bucket, object)
+	}
+	return nil
+}
+
+// Load the exported JSON object into the day partition of a BigQuery table
+// (project.dataset.table), which is created if needed. Partitions are replaced,
+// so loading a day again does not duplicate its rows.
+func (chargeback *Chargeback) LoadTable(ctx context.Context, bucket string, table string) error {
+	tokens := strings.Split(table, ".")
+	if len(tokens) != 3 {
+		return fmt.Errorf("invalid chargeback table, expected project.dataset.table: %s", table)
+	}
+	date, err := time.Parse(chargebackDate, chargeback.Date)
+	if err != nil {
+		return err
+	}
+
+	client, err := bigquerySDK.NewService(ctx)
+	if err != nil {
+		return err
+	}
+
+	job := &bigquerySDK.Job{
+		Configuration: &bigquerySDK.JobConfiguration{
+			Load: &bigquerySDK.JobConfigurationLoad{
+				SourceUris:   []string{fmt.Sprintf("gs://%s/%s", bucket, chargeback.Objects()[1])},
+				SourceFormat: "NEWLINE_DELIMITED_JSON",
+				DestinationTable: &bigquerySDK.TableReference{
+					ProjectId: tokens[0],
+					DatasetId: tokens[1],
+					TableId:   fmt.Sprintf("%s$%s", tokens[2], date.Format("20060102")),
+				},
+				Schema: &bigquerySDK.TableSchema{
+					Fields: []*bigquerySDK.TableFieldSchema{
+						{Name: "date", Type: "DATE", Mode: "REQUIRED"},
+						{Name: "reservation", Type: "STRING", Mode: "REQUIRED"},
+						{Name: "project", Type: "STRING"},
+						{Name: "folder", Type: "STRING"},
+						{Name: "label", Type: "STRING"},
+						{Name: "used_slot_hours", Type: "FLOAT"},
+						{Name: "idle_slot_hours", Type: "FLOAT"},
+						{Name: "slot_hours", Type: "FLOAT"},
+					},
+				},
+				TimePartitioning:  &bigquerySDK.TimePartitioning{Type: "DAY", Field: "date"},
+				CreateDisposition: "CREATE_IF_NEEDED",
+				WriteDisposition:  "WRITE_TRUNCATE",
+			},
+		},
+	}
+	job, err = client.Jobs.Insert(tokens[0], job).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	// Wait for the load to complete, so failures are reported to the caller
+	for job.Status == nil || job.Status.State != "DONE" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(chargebackPollInterval):
+		}
+		job, err = client.Jobs.Get(tokens[0], job.JobReference.JobId).Location(job.JobReference.Location).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+	}
+	if job.Status.ErrorResult != nil {
+		return fmt.Errorf("failed to load chargeback into %s: %s", table, job.Status.ErrorResult.Message)
+	}
+	log.Printf("loaded %d chargeback rows into %s\n", len(chargeback.Rows), table)
+	return nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	chatSDK "google.golang.org/api/chat/v1"
+	googleapi "google.golang.org/api/googleapi"
+	option "google.golang.org/api/option"
+)
+
+// OAuth scope of the Chat API for apps
+const chatBotScope = "https://www.googleapis.com/auth/chat.bot"
+
+// Client for the Google Chat API, authenticated as the Chat app through the
+// default service account
+type ChatClient struct {
+	service *chatSDK.Service
+	policy  DeliveryPolicy
+}
+
+// Create a Google Chat client
+func NewChatClient(ctx context.Context, policy DeliveryPolicy) (*ChatClient, error) {
+	service, err := chatSDK.NewService(ctx, option.WithScopes(chatBotScope))
+	if err != nil {
+		return nil, err
+	}
+	return &ChatClient{service: service, policy: policy}, nil
+}
+
+// Post a message to a space (spaces/<space>), optionally with a card. Thread is
+// either the name of an existing thread (spaces/<space>/threads/<thread>) or a
+// key, which starts a new thread on first use. Returns the thread and name of the
+// message.
+func (client *ChatClient) PostMessage(ctx context.Context, space string, text string, card map[string]interface{}, thread string) (Thread, error) {
+	posted, _, err := client.postMessage(ctx, space, text, card, thread, client.policy)
+	return posted, err
+}
+
+// Post a message, retrying according to the given policy
+func (client *ChatClient) postMessage(ctx context.Context, space string, text string, card map[string]interface{}, thread string, policy DeliveryPolicy) (Thread, int, error) {
+	message := &chatSDK.Message{Text: text}
+	if card != nil {
+		// Cards are built as plain maps, like for Slack, so convert them
+		data, err := json.Marshal(card)
+		if err != nil {
+			return Thread{}, 0, err
+		}
+		cardWithID := &chatSDK.CardWithId{}
+		err = json.Unmarshal(data, cardWithID)
+		if err != nil {
+			return Thread{}, 0, err
+		}
+		message.CardsV2 = []*chatSDK.CardWithId{cardWithID}
+	}
+
+	call := client.service.Spaces.Messages.Create(space, message)
+	switch {
+	case strings.HasPrefix(thread, "spaces/"):
+		message.Thread = &chatSDK.Thread{Name: thread}
+		call = call.MessageReplyOption("REPLY_MESSAGE_FALLBACK_TO_NEW_THREAD")
+	case thread != "":
+		message.Thread = &chatSDK.Thread{ThreadKey: thread}
+		call = call.MessageReplyOption("REPLY_MESSAGE_FALLBACK_TO_NEW_THREAD")
+	}
+
+	var created *chatSDK.Message
+	attempts, err := withRetries(ctx, policy, func(ctx context.Context) (time.Duration, *DeliveryError) {
+		var err error
+		created, err = call.Context(ctx).Do()
+		return chatRetry(err)
+	})
+	if err != nil {
+		return Thread{}, attempts, err
+	}
+
+	posted := Thread{Channel: space, Message: created.Name}
+	if created.Thread != nil {
+		posted.Thread = created.Thread.Name
+	}
+	return posted, attempts, nil
+}
+
+// Replace text and cards of a message (spaces/<space>/messages/<message>)
+// posted by the app, retrying according to the given policy
+func (client *ChatClient) updateMessage(ctx context.Context, name string, text string, policy DeliveryPolicy) (int, error) {
+	call := client.service.Spaces.Messages.Patch(name, &chatSDK.Message{Text: text}).UpdateMask("text,cards_v2")
+	return withRetries(ctx, policy, func(ctx context.Context) (time.Duration, *DeliveryError) {
+		_, err := call.Context(ctx).Do()
+		return chatRetry(err)
+	})
+}
+
+// Classify the error of a Chat API call, retrying on rate limits, server and
+// network errors only, see requestRetry
+func chatRetry(err error) (time.Duration, *DeliveryError) {
+	if err == nil {
+		return 0, nil
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		deliveryErr := &DeliveryError{StatusCode: apiErr.Code, Err: err}
+		if apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500 {
+			return retryAfter(apiErr.Header.Get("Retry-After")), deliveryErr
+		}
+		return -1, deliveryErr
+	}
+	return requestRetry(err)
+}
+
+// Notifier posting to a Google Chat space as Chat app. Every alerting reservation
+// is posted separately, threaded by its incident, so all updates on one breach
+// land in the same thread. The first message is updated once the incident resolves.
+type ChatNotifier struct {
+	name      string
+	space     string
+	client    *ChatClient
+	templates *Templates
+	policy    DeliveryPolicy
+
+	// Action buttons added to the messages, if set
+	Actions *AlertActions
+}
+
+// Create a Chat app notifier posting to the given space (spaces/<space>)
+func NewChatNotifier(name string, space string, client *ChatClient, templates *Templates, policy DeliveryPolicy) (*ChatNotifier, error) {
+	if !strings.HasPrefix(space, "spaces/") {
+		return nil, fmt.Errorf("invalid space of notifier %s, expected spaces/<space>: '%s'", name, space)
+	}
+	if client == nil {
+		return nil, fmt.Errorf("chat client of notifier %s not available", name)
+	}
+	return &ChatNotifier{name: name, space: space, client: client, templates: templates, policy: policy}, nil
+}
+
+// Name of the notifier instance
+func (notifier *ChatNotifier) Name() string {
+	return notifier.name
+}
+
+// Render the state per reservation and post it to the thread of its incident
+func (notifier *ChatNotifier) Notify(ctx context.Context, state *State) Delivery {
+	log.Printf("publishing message to %s\n", notifier.name)
+
+	return notifyThreads(ctx, notifier.name, notifier.templates, state, func(ctx context.Context, id string, single *State, message string, thread Thread, threaded bool) (Thread, int, error) {
+		var card map[string]interface{}
+		if notifier.Actions != nil {
+			card = notifier.Actions.ChatCard(single, message)
+			message = ""
+		}
+
+		// Reply to the known thread, falling back to the key of the incident
+		key := ThreadKey(id, single.Reservations[id])
+		if threaded {
+			key = thread.Thread
+		}
+		return notifier.client.postMessage(ctx, notifier.space, message, card, key, notifier.policy)
+	})
+}
+
+// Resolve incidents, see resolveThreads
+func (notifier *ChatNotifier) Resolve(ctx context.Context, transitions []Transition) Delivery {
+	update := func(ctx context.Context, thread Thread, text string) (int, error) {
+		// Replace the alert including its buttons, which are no longer of use
+		return notifier.client.updateMessage(ctx, thread.Message, fmt.Sprintf("\u2705 %s", text), notifier.policy)
+	}
+	reply := func(ctx context.Context, thread Thread, text string) (int, error) {
+		_, tries, err := notifier.client.postMessage(ctx, thread.Channel, text, nil, thread.Thread, notifier.policy)
+		return tries, err
+	}
+	return resolveThreads(ctx, notifier.name, notifier.templates, transitions, update, reply)
+}
+
+// Key of the thread holding all messages on the current incident of a reservation
+func ThreadKey(id string, reservation Reservation) string {
+	if reservation.AlertingSince == nil {
+		return id
+	}
+	return fmt.Sprintf("%s-%d", id, reservation.AlertingSince.Unix())
+}
+
+// Render the report and post it to the space, in a thread of its own
+func (notifier *ChatNotifier) NotifyReport(ctx context.Context, report Report) Delivery {
+	log.Printf("publishing report to %s\n", notifier.name)
+
+	state := report.state()
+	message, err := report.render(notifier.templates)
+	if err != nil {
+		return NewDelivery(notifier.name, state, 0, err)
+	}
+	_, attempts, err := notifier.client.postMessage(ctx, notifier.space, message, nil, "", notifier.policy)
+	return NewDelivery(notifier.name, state, attempts, err)
+}
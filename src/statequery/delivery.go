@@ -0,0 +1,306 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	storageSDK "cloud.google.com/go/storage"
+)
+
+// Outcomes of delivering alerts to a notifier
+const (
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliverySkipped   = "skipped"
+)
+
+// Maximum number of response body bytes kept for error messages
+const maxErrorBody = 512
+
+// Result of delivering alerts to a single notifier
+type Delivery struct {
+	Notifier     string    `json:"notifier"`
+	Status       string    `json:"status"`
+	Attempts     int       `json:"attempts"`
+	StatusCode   int       `json:"status_code,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Reservations []string  `json:"reservations"`
+	Timestamp    time.Time `json:"timestamp"`
+	DeadLetter   string    `json:"dead_letter,omitempty"`
+
+	// Threads started per reservation by threaded notifiers
+	Threads map[string]Thread `json:"-"`
+}
+
+// Undeliverable alerts, archived for inspection and manual replay
+type DeadLetter struct {
+	Delivery Delivery `json:"delivery"`
+	State    *State   `json:"state"`
+}
+
+// Retry and timeout settings for delivering alerts to a notifier
+type DeliveryPolicy struct {
+	// Deadline for the whole delivery, including all retries
+	Timeout Duration `json:"timeout"`
+	// Maximum number of attempts, including the first one
+	MaxAttempts int `json:"max_attempts"`
+	// Backoff before the first retry, doubled on each further retry
+	InitialBackoff Duration `json:"initial_backoff"`
+	// Upper bound for backoffs, also applied to Retry-After headers
+	MaxBackoff Duration `json:"max_backoff"`
+}
+
+// Error of an HTTP request to a notifier, carrying the response status if any
+type DeliveryError struct {
+	StatusCode int
+	Attempts   int
+	Err        error
+}
+
+func (err *DeliveryError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *DeliveryError) Unwrap() error {
+	return err.Err
+}
+
+// Fill in defaults for unset fields of a delivery policy
+func (policy DeliveryPolicy) withDefaults() DeliveryPolicy {
+	if policy.Timeout.Duration <= 0 {
+		policy.Timeout.Duration = 30 * time.Second
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 4
+	}
+	if policy.InitialBackoff.Duration <= 0 {
+		policy.InitialBackoff.Duration = time.Second
+	}
+	if policy.MaxBackoff.Duration <= 0 {
+		policy.MaxBackoff.Duration = 10 * time.Second
+	}
+	return policy
+}
+
+// POST a JSON payload, retrying on network errors, 429 and 5xx responses with
+// exponential backoff. Retry-After headers are honored up to the maximum backoff.
+// Other non-2xx responses fail immediately, e.g. for revoked webhooks. Returns the
+// number of attempts made.
+func postJSON(ctx context.Context, url string, header http.Header, payload interface{}, policy DeliveryPolicy) (int, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	return withRetries(ctx, policy, func(ctx context.Context) (time.Duration, *DeliveryError) {
+		return postOnce(ctx, url, header, data)
+	})
+}
+
+// POST a JSON payload with the default delivery policy, e.g. to respond to callbacks
+func PostJSON(ctx context.Context, url string, payload interface{}) error {
+	_, err := postJSON(ctx, url, nil, payload, DeliveryPolicy{})
+	return err
+}
+
+// Call attempt until it succeeds, fails permanently or the policy is exhausted.
+// On failure, attempt returns how long to wait before retrying: zero for the
+// default backoff, or negative if the error is permanent. Returns the number of
+// attempts made.
+func withRetries(ctx context.Context, policy DeliveryPolicy, attempt func(ctx context.Context) (time.Duration, *DeliveryError)) (int, error) {
+	policy = policy.withDefaults()
+	ctx, cancel := context.WithTimeout(ctx, policy.Timeout.Duration)
+	defer cancel()
+
+	backoff := policy.InitialBackoff.Duration
+	for attempts := 1; ; attempts++ {
+		wait, err := attempt(ctx)
+		if err == nil {
+			return attempts, nil
+		}
+		err.Attempts = attempts
+		if wait < 0 || attempts >= policy.MaxAttempts {
+			return attempts, err
+		}
+
+		// Prefer the server's Retry-After over the own backoff
+		if wait == 0 {
+			wait = backoff
+			backoff *= 2
+		}
+		if wait > policy.MaxBackoff.Duration {
+			wait = policy.MaxBackoff.Duration
+		}
+		log.Printf("attempt %d failed, retrying in %v: %v\n", attempts, wait, err)
+
+		select {
+		case <-ctx.Done():
+			return attempts, &DeliveryError{StatusCode: err.StatusCode, Attempts: attempts, Err: fmt.Errorf("%v (gave up: %v)", err.Err, ctx.Err())}
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Make a single POST request. On failure, returns how long to wait before retrying:
+// zero for the default backoff, or negative if the error is permanent.
+func postOnce(ctx context.Context, url string, header http.Header, data []byte) (time.Duration, *DeliveryError) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return -1, &DeliveryError{Err: err}
+	}
+	if !webhookScheme(request.URL) {
+		return -1, &DeliveryError{Err: fmt.Errorf("unsupported webhook URL scheme: %q", request.URL.Scheme)}
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, values := range header {
+		request.Header[key] = values
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return requestRetry(err)
+	}
+	defer response.Body.Close()
+
+	// Drain the body, so the connection can be reused, but keep the start for errors
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return 0, nil
+	}
+	deliveryErr := &DeliveryError{
+		StatusCode: response.StatusCode,
+		Err:        fmt.Errorf("unexpected response %s", response.Status),
+	}
+	if message := strings.TrimSpace(string(body)); message != "" {
+		deliveryErr.Err = fmt.Errorf("unexpected response %s: %s", response.Status, message)
+	}
+	if response.StatusCode != http.StatusTooManyRequests && response.StatusCode < 500 {
+		return -1, deliveryErr
+	}
+	return retryAfter(response.Header.Get("Retry-After")), deliveryErr
+}
+
+// Classify the error of a request, which did not receive a response. Only network
+// errors, e.g. timeouts, refused or reset connections, may be transient. Others,
+// e.g. of TLS handshakes, malformed URLs or redirect policies, are not retried.
+func requestRetry(err error) (time.Duration, *DeliveryError) {
+	// The client wraps all errors, so classify the wrapped one
+	cause := err
+	var urlErr *neturl.Error
+	if errors.As(err, &urlErr) {
+		cause = urlErr.Err
+	}
+
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.As(cause, &netErr) && netErr.Timeout():
+	case errors.Is(cause, syscall.ECONNRESET), errors.Is(cause, syscall.ECONNREFUSED):
+	case errors.As(cause, &opErr):
+	default:
+		return -1, &DeliveryError{Err: err}
+	}
+	return 0, &DeliveryError{Err: err}
+}
+
+// Whether a webhook URL is configured, i.e. an absolute http(s) URL. Placeholders
+// of unconfigured secrets, e.g. 'invalid', are skipped like empty URLs.
+func webhookConfigured(url string) bool {
+	parsed, err := neturl.Parse(url)
+	return err == nil && webhookScheme(parsed) && parsed.Host != ""
+}
+
+// Whether a URL has a scheme webhooks can be posted to
+func webhookScheme(url *neturl.URL) bool {
+	return url.Scheme == "http" || url.Scheme == "https"
+}
+
+// Parse a Retry-After header, given either in seconds or as HTTP date
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(value)
+	if err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err == nil && time.Until(date) > 0 {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// Record the outcome of a delivery attempt
+func NewDelivery(notifier string, state *State, attempts int, err error) Delivery {
+	delivery := Delivery{
+		Notifier:     notifier,
+		Status:       DeliveryDelivered,
+		Attempts:     attempts,
+		Reservations: []string{},
+		Timestamp:    time.Now().UTC(),
+	}
+	for id := range state.Reservations {
+		delivery.Reservations = append(delivery.Reservations, id)
+	}
+	sort.Strings(delivery.Reservations)
+
+	if err != nil {
+		delivery.Status = DeliveryFailed
+		delivery.Error = err.Error()
+		if deliveryErr, ok := err.(*DeliveryError); ok {
+			delivery.StatusCode = deliveryErr.StatusCode
+		}
+	}
+	return delivery
+}
+
+// Archive undeliverable alerts under 'dead-letter/' in the bucket, returning the
+// object name
+func WriteDeadLetter(ctx context.Context, bucket string, delivery Delivery, state *State) (string, error) {
+	if bucket == "" {
+		return "", fmt.Errorf("bucket for dead letters not configured")
+	}
+
+	client, err := storageSDK.NewClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	object := fmt.Sprintf("dead-letter/%d-%s.json", state.Timestamp.Unix(), delivery.Notifier)
+	_, err = writeObject(ctx, client, bucket, object, DeadLetter{Delivery: delivery, State: state}, 0)
+	if err != nil {
+		return "", err
+	}
+	return object, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Policy retrying quickly, so tests do not wait for backoffs
+var testPolicy = DeliveryPolicy{
+	Timeout:        Duration{5 * time.Second},
+	MaxAttempts:    3,
+	InitialBackoff: Duration{time.Millisecond},
+	MaxBackoff:     Duration{time.Millisecond},
+}
+
+func TestPostUntrustedCertificate(t *testing.T) {
+	var requests int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	attempts, err := postJSON(context.Background(), server.URL, nil, map[string]string{"text": "alert"}, testPolicy)
+	if err == nil {
+		t.Fatal("expected delivery to a server with untrusted certificate to fail")
+	}
+	if attempts != 1 {
+		t.Errorf("expected a single attempt, got %d", attempts)
+	}
+	if requests != 0 {
+		t.Errorf("expected no requests to be handled, got %d", requests)
+	}
+}
+
+func TestPostRefusedConnection(t *testing.T) {
+	// Reserve a port and close it again, so connections are refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	url := "http://" + listener.Addr().String()
+	listener.Close()
+
+	attempts, err := postJSON(context.Background(), url, nil, map[string]string{"text": "alert"}, testPolicy)
+	if err == nil {
+		t.Fatal("expected delivery to a closed port to fail")
+	}
+	if attempts != testPolicy.MaxAttempts {
+		t.Errorf("expected %d attempts, got %d", testPolicy.MaxAttempts, attempts)
+	}
+}
+
+func TestPostRedirectPolicy(t *testing.T) {
+	// Redirect loops exceed the redirect limit of the client
+	var requests int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Redirect(w, r, server.URL, http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	attempts, err := postJSON(context.Background(), server.URL, nil, map[string]string{"text": "alert"}, testPolicy)
+	if err == nil {
+		t.Fatal("expected delivery stuck in redirects to fail")
+	}
+	if attempts != 1 {
+		t.Errorf("expected a single attempt, got %d after %d requests", attempts, requests)
+	}
+}
+
+func TestPostRetriesServerErrors(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	attempts, err := postJSON(context.Background(), server.URL, nil, map[string]string{"text": "alert"}, testPolicy)
+	if err != nil {
+		t.Fatalf("expected delivery to succeed after a retry, got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestRequestRetry(t *testing.T) {
+	wrap := func(err error) error {
+		return &neturl.Error{Op: "Post", URL: "https://example.com", Err: err}
+	}
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"untrusted certificate", wrap(x509.UnknownAuthorityError{}), false},
+		{"redirect policy", wrap(errors.New("stopped after 10 redirects")), false},
+		{"refused connection", wrap(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), true},
+		{"reset connection", wrap(syscall.ECONNRESET), true},
+		{"timeout", wrap(context.DeadlineExceeded), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, classify := range []func(error) (time.Duration, *DeliveryError){requestRetry, chatRetry} {
+				wait, err := classify(test.err)
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if (wait >= 0) != test.retryable {
+					t.Errorf("expected retryable %v, got wait %v", test.retryable, wait)
+				}
+			}
+		})
+	}
+}
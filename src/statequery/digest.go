@@ -0,0 +1,245 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Longest time a single state is taken to represent, so gaps in the history
+// (e.g. paused scans) do not count as time spent above the threshold
+const maxSampleGap = time.Hour
+
+// Number of projects and users listed per reservation in digests
+const digestTopConsumers = 5
+
+// Summary of the utilization of all reservations over a period
+type Digest struct {
+	Period       string                       `json:"period"`
+	From         time.Time                    `json:"from"`
+	To           time.Time                    `json:"to"`
+	Threshold    float64                      `json:"threshold"`
+	Reservations map[string]ReservationDigest `json:"reservations"`
+}
+
+// Utilization statistics of a reservation over the period of a digest.
+// Utilizations are fractions of the slot capacity.
+type ReservationDigest struct {
+	Name         string     `json:"name"`
+	Location     string     `json:"location"`
+	AdminProject string     `json:"admin_project,omitempty"`
+	Slots        float64    `json:"slots"`
+	Samples      int        `json:"samples"`
+	Peak         float64    `json:"peak"`
+	Average      float64    `json:"average"`
+	P95          float64    `json:"p95"`
+	HoursAbove   float64    `json:"hours_above_threshold"`
+	TopProjects  []Consumer `json:"top_projects"`
+	TopUsers     []Consumer `json:"top_users"`
+}
+
+// Name and location of the reservation for display, see Reservation.Title
+func (digest ReservationDigest) Title() string {
+	return Reservation{Name: digest.Name, Location: digest.Location, AdminProject: digest.AdminProject}.Title()
+}
+
+// Project or user by the slot-hours it consumed
+type Consumer struct {
+	Name      string  `json:"name"`
+	SlotHours float64 `json:"slot_hours"`
+}
+
+// Utilization of a reservation in a single archived state
+type digestSample struct {
+	timestamp   time.Time
+	reservation Reservation
+	utilization float64
+	projects    map[string]float64
+	users       map[string]float64
+}
+
+// Aggregate the states archived in the bucket between from and to into a digest.
+// Each state is taken to represent the time until the next one, bounded by
+// maxSampleGap, to compute hours above the threshold and slot-hours per consumer.
+func BuildDigest(ctx context.Context, bucket string, period string, from time.Time, to time.Time, threshold float64) (*Digest, error) {
+	// Keep only what is needed of each state, as long periods hold many states
+	samples := make(map[string][]digestSample)
+	err := WalkHistory(ctx, bucket, from, func(state *State) {
+		if state.Timestamp.After(to) {
+			return
+		}
+		for id, reservation := range state.Reservations {
+			sample := digestSample{
+				timestamp:   state.Timestamp,
+				reservation: Reservation{Name: reservation.Name, Location: reservation.Location, AdminProject: reservation.AdminProject, Slots: reservation.Slots},
+				utilization: reservation.UtilizationFactor(),
+				projects:    make(map[string]float64),
+				users:       make(map[string]float64),
+			}
+			for _, job := range reservation.Jobs {
+				project := job.Project
+				if project == "" {
+					project = strings.SplitN(job.Name, ":", 2)[0]
+				}
+				sample.projects[project] += job.Usage
+				sample.users[job.User] += job.Usage
+			}
+			samples[id] = append(samples[id], sample)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	digest := &Digest{
+		Period:       period,
+		From:         from,
+		To:           to,
+		Threshold:    threshold,
+		Reservations: make(map[string]ReservationDigest),
+	}
+	for id, series := range samples {
+		digest.Reservations[id] = summarize(series, to, threshold)
+	}
+	return digest, nil
+}
+
+// Compute the statistics of a reservation from its samples
+func summarize(series []digestSample, to time.Time, threshold float64) ReservationDigest {
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].timestamp.Before(series[j].timestamp)
+	})
+
+	// Capacity and names as of the end of the period
+	last := series[len(series)-1].reservation
+	summary := ReservationDigest{
+		Name:         last.Name,
+		Location:     last.Location,
+		AdminProject: last.AdminProject,
+		Slots:        last.Slots,
+		Samples:      len(series),
+	}
+
+	utilizations := make([]float64, 0, len(series))
+	projects := make(map[string]float64)
+	users := make(map[string]float64)
+	total := 0.0
+	for i, sample := range series {
+		utilizations = append(utilizations, sample.utilization)
+		total += sample.utilization
+		summary.Peak = math.Max(summary.Peak, sample.utilization)
+
+		end := to
+		if i+1 < len(series) {
+			end = series[i+1].timestamp
+		}
+		hours := math.Min(end.Sub(sample.timestamp).Hours(), maxSampleGap.Hours())
+		if sample.utilization >= threshold {
+			summary.HoursAbove += hours
+		}
+		for project, slots := range sample.projects {
+			projects[project] += slots * hours
+		}
+		for user, slots := range sample.users {
+			users[user] += slots * hours
+		}
+	}
+	summary.Average = total / float64(len(series))
+	summary.P95 = percentile(utilizations, 0.95)
+	summary.TopProjects = topConsumers(projects, digestTopConsumers)
+	summary.TopUsers = topConsumers(users, digestTopConsumers)
+	return summary
+}
+
+// Nearest-rank percentile of the values, which are sorted in place
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	rank := int(math.Ceil(p*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return values[rank]
+}
+
+// Sort consumers by slot-hours, keeping at most n
+func topConsumers(slotHours map[string]float64, n int) []Consumer {
+	consumers := make([]Consumer, 0, len(slotHours))
+	for name, hours := range slotHours {
+		consumers = append(consumers, Consumer{Name: name, SlotHours: hours})
+	}
+	sort.Slice(consumers, func(i, j int) bool {
+		if consumers[i].SlotHours != consumers[j].SlotHours {
+			return consumers[i].SlotHours > consumers[j].SlotHours
+		}
+		return consumers[i].Name < consumers[j].Name
+	})
+	if len(consumers) > n {
+		consumers = consumers[:n]
+	}
+	return consumers
+}
+
+// Render the digest with the templates of a notifier
+func (digest *Digest) render(templates *Templates) (string, error) {
+	return templates.Digest(digest)
+}
+
+// State holding the reservations of a digest, to report deliveries on them
+func (digest *Digest) state() *State {
+	state := &State{Timestamp: digest.To, Reservations: make(map[string]Reservation)}
+	for id, reservation := range digest.Reservations {
+		state.Reservations[id] = Reservation{Name: reservation.Name, Location: reservation.Location, AdminProject: reservation.AdminProject, Slots: reservation.Slots}
+	}
+	return state
+}
+
+// Subject line of digest emails
+func (digest *Digest) subject() string {
+	return fmt.Sprintf("BigQuery reservation %s digest: %s to %s", digest.Period,
+		digest.From.Format("2006-01-02 15:04"), digest.To.Format("2006-01-02 15:04 MST"))
+}
+
+// Digest exercising all parts of digest templates
+func sampleDigest() *Digest {
+	now := time.Now().UTC()
+	return &Digest{
+		Period:    "daily",
+		From:      now.Add(-24 * time.Hour),
+		To:        now,
+		Threshold: 0.8,
+		Reservations: map[string]ReservationDigest{
+			"US.sample": {
+				Name:        "sample",
+				Location:    "US",
+				Slots:       1000,
+				Samples:     288,
+				Peak:        0.95,
+				Average:     0.6,
+				P95:         0.9,
+				HoursAbove:  2.5,
+				TopProjects: []Consumer{{Name: "project", SlotHours: 12000}},
+				TopUsers:    []Consumer{{Name: "user@example.com", SlotHours: 8000}},
+			},
+		},
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Connection security of SMTP servers
+const (
+	SMTPSecurityStartTLS = "starttls"
+	SMTPSecurityTLS      = "tls"
+	SMTPSecurityNone     = "none"
+)
+
+// Settings of an SMTP server and the mails sent through it
+type EmailConfig struct {
+	Host string
+	Port int
+	// One of 'starttls' (default), 'tls' or 'none'
+	Security string
+	Username string
+	// Resolved on every notification, so rotated secrets are picked up
+	Password func() string
+	From     string
+	To       []string
+}
+
+// Notifier sending the report as mail with HTML and plain-text bodies via SMTP
+type EmailNotifier struct {
+	name      string
+	config    EmailConfig
+	templates *Templates
+	policy    DeliveryPolicy
+
+	// Certificates to verify the server with, defaulting to the system's
+	rootCAs *x509.CertPool
+}
+
+// Create an email notifier. Passwords are only sent over TLS, or to the local
+// host, so authenticating without security is rejected.
+func NewEmailNotifier(name string, config EmailConfig, templates *Templates, policy DeliveryPolicy) (*EmailNotifier, error) {
+	if config.Host == "" || config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("email notifier %s requires host, sender and recipients", name)
+	}
+	switch config.Security {
+	case "":
+		config.Security = SMTPSecurityStartTLS
+	case SMTPSecurityStartTLS, SMTPSecurityTLS, SMTPSecurityNone:
+	default:
+		return nil, fmt.Errorf("unknown SMTP security %s of notifier %s", config.Security, name)
+	}
+	if config.Security == SMTPSecurityNone && config.Username != "" && !localHost(config.Host) {
+		return nil, fmt.Errorf("email notifier %s cannot authenticate to %s without TLS, use security starttls or tls", name, config.Host)
+	}
+	if config.Port == 0 {
+		config.Port = 587
+		if config.Security == SMTPSecurityTLS {
+			config.Port = 465
+		}
+	}
+	return &EmailNotifier{name: name, config: config, templates: templates, policy: policy}, nil
+}
+
+// Whether a host is the local one, to which smtp.PlainAuth sends passwords without TLS
+func localHost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// Name of the notifier instance
+func (notifier *EmailNotifier) Name() string {
+	return notifier.name
+}
+
+// Render the state and send it to all recipients
+func (notifier *EmailNotifier) Notify(ctx context.Context, state *State) Delivery {
+	log.Printf("sending mail to %s\n", notifier.name)
+
+	// Render both bodies up front, as they do not change between attempts
+	text, err := notifier.templates.Firing(state)
+	if err != nil {
+		return NewDelivery(notifier.name, state, 0, err)
+	}
+	html, err := notifier.templates.FiringHTML(state)
+	if err != nil {
+		return NewDelivery(notifier.name, state, 0, err)
+	}
+	message, err := notifier.compose(state.subject(), text, html)
+	if err != nil {
+		return NewDelivery(notifier.name, state, 0, err)
+	}
+
+	attempts, err := withRetries(ctx, notifier.policy, func(ctx context.Context) (time.Duration, *DeliveryError) {
+		return notifier.send(ctx, message)
+	})
+	return NewDelivery(notifier.name, state, attempts, err)
+}
+
+// Render the report and send it to all recipients as plain text
+func (notifier *EmailNotifier) NotifyReport(ctx context.Context, report Report) Delivery {
+	log.Printf("sending report mail to %s\n", notifier.name)
+
+	state := report.state()
+	text, err := report.render(notifier.templates)
+	if err != nil {
+		return NewDelivery(notifier.name, state, 0, err)
+	}
+	message, err := notifier.compose(report.subject(), text, "")
+	if err != nil {
+		return NewDelivery(notifier.name, state, 0, err)
+	}
+
+	attempts, err := withRetries(ctx, notifier.policy, func(ctx context.Context) (time.Duration, *DeliveryError) {
+		return notifier.send(ctx, message)
+	})
+	return NewDelivery(notifier.name, state, attempts, err)
+}
+
+// Build the MIME message with plain-text and, unless empty, HTML alternatives
+func (notifier *EmailNotifier) compose(subject string, text string, html string) ([]byte, error) {
+	alternatives := [][2]string{{"text/plain; charset=utf-8", text}}
+	// Clients display the last alternative they support, so HTML goes last
+	if html != "" {
+		alternatives = append(alternatives, [2]string{"text/html; charset=utf-8", html})
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, alternative := range alternatives {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", alternative[0])
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		part, err := parts.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		encoder := quotedprintable.NewWriter(part)
+		_, err = encoder.Write([]byte(alternative[1]))
+		if err != nil {
+			return nil, err
+		}
+		encoder.Close()
+	}
+	parts.Close()
+
+	id := make([]byte, 12)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	domain := notifier.config.From[strings.LastIndex(notifier.config.From, "@")+1:]
+
+	var message bytes.Buffer
+	headers := [][2]string{
+		{"From", notifier.config.From},
+		{"To", strings.Join(notifier.config.To, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", fmt.Sprintf("multipart/alternative; boundary=%s", parts.Boundary())},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&message, "%s: %s\r\n", header[0], header[1])
+	}
+	message.WriteString("\r\n")
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+// Subject line naming the reservations in the report
+func (state *State) subject() string {
+	var names []string
+	for _, reservation := range state.Reservations {
+		names = append(names, reservation.Title())
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("BigQuery reservation alert: %s", strings.Join(names, ", "))
+}
+
+// Deliver the message in a single SMTP session, see smtpError for retries
+func (notifier *EmailNotifier) send(ctx context.Context, message []byte) (time.Duration, *DeliveryError) {
+	config := notifier.config
+	address := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	tlsConfig := &tls.Config{ServerName: config.Host, RootCAs: notifier.rootCAs}
+
+	// Bound the whole session by the context deadline
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if config.Security == SMTPSecurityTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return smtpError(err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		return smtpError(err)
+	}
+	defer client.Close()
+
+	if config.Security == SMTPSecurityStartTLS {
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			return smtpError(err)
+		}
+	}
+
+	if config.Username != "" {
+		password := ""
+		if config.Password != nil {
+			password = config.Password()
+		}
+		err = client.Auth(smtp.PlainAuth("", config.Username, password, config.Host))
+		if err != nil {
+			return smtpError(err)
+		}
+	}
+
+	err = client.Mail(config.From)
+	if err != nil {
+		return smtpError(err)
+	}
+	for _, recipient := range config.To {
+		err = client.Rcpt(recipient)
+		if err != nil {
+			return smtpError(err)
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return smtpError(err)
+	}
+	_, err = writer.Write(message)
+	if err != nil {
+		return smtpError(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return smtpError(err)
+	}
+	client.Quit()
+	return 0, nil
+}
+
+// Classify an SMTP error, retrying transient (4xx) replies, network errors and
+// dropped connections. Permanent (5xx) replies and other errors, e.g. of TLS
+// handshakes or authentication, are not.
+func smtpError(err error) (time.Duration, *DeliveryError) {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		deliveryErr := &DeliveryError{StatusCode: reply.Code, Err: err}
+		if reply.Code >= 500 {
+			return -1, deliveryErr
+		}
+		return 0, deliveryErr
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return -1, &DeliveryError{Err: err}
+	}
+	return 0, &DeliveryError{Err: err}
+}
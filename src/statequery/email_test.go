@@ -0,0 +1,367 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Session recorded by the fake SMTP server
+type smtpSession struct {
+	startTLS   bool
+	tlsAuth    bool
+	username   string
+	password   string
+	from       string
+	recipients []string
+	data       []byte
+}
+
+// In-process SMTP server accepting a single message per session
+type fakeSMTPServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	// Reply to RCPT commands, defaulting to accepting all recipients
+	rcptReply string
+
+	mutex    sync.Mutex
+	sessions []*smtpSession
+}
+
+func newFakeSMTPServer(t *testing.T, tlsConfig *tls.Config) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := &fakeSMTPServer{listener: listener, tls: tlsConfig, rcptReply: "250 ok"}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeSMTPServer) port() int {
+	return server.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (server *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	session := &smtpSession{}
+	server.mutex.Lock()
+	server.sessions = append(server.sessions, session)
+	server.mutex.Unlock()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake ESMTP")
+	secure := false
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		argument := strings.TrimSpace(strings.TrimPrefix(line, strings.SplitN(line, " ", 2)[0]))
+
+		server.mutex.Lock()
+		switch command {
+		case "EHLO":
+			lines := []string{"fake"}
+			if server.tls != nil && !secure {
+				lines = append(lines, "STARTTLS")
+			}
+			lines = append(lines, "AUTH PLAIN")
+			for i, value := range lines {
+				separator := "-"
+				if i == len(lines)-1 {
+					separator = " "
+				}
+				text.PrintfLine("250%s%s", separator, value)
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, server.tls)
+			err = tlsConn.Handshake()
+			if err != nil {
+				server.mutex.Unlock()
+				return
+			}
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+			session.startTLS = true
+			secure = true
+		case "AUTH":
+			tokens := strings.Fields(argument)
+			credentials, _ := base64.StdEncoding.DecodeString(tokens[len(tokens)-1])
+			fields := strings.Split(string(credentials), "\x00")
+			if len(fields) == 3 {
+				session.username, session.password = fields[1], fields[2]
+			}
+			session.tlsAuth = secure
+			text.PrintfLine("235 authenticated")
+		case "MAIL":
+			session.from = strings.Trim(strings.TrimPrefix(argument, "FROM:"), "<>")
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			session.recipients = append(session.recipients, strings.Trim(strings.TrimPrefix(argument, "TO:"), "<>"))
+			text.PrintfLine(server.rcptReply)
+		case "DATA":
+			text.PrintfLine("354 send data")
+			server.mutex.Unlock()
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			server.mutex.Lock()
+			session.data = data
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			server.mutex.Unlock()
+			return
+		default:
+			text.PrintfLine("250 ok")
+		}
+		server.mutex.Unlock()
+	}
+}
+
+func (server *fakeSMTPServer) session(t *testing.T) *smtpSession {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.sessions) == 0 {
+		t.Fatalf("no SMTP session recorded")
+	}
+	return server.sessions[len(server.sessions)-1]
+}
+
+// Self-signed certificate for 127.0.0.1, along with a pool trusting it
+func testCertificate(t *testing.T) (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, pool
+}
+
+// Templates rendering short inline messages
+func testTemplates(t *testing.T) *Templates {
+	templates, err := LoadTemplates(context.Background(), TemplateSources{
+		TemplateFiring:      "{{len .Reservations}} reservations alerting",
+		TemplateFiringHTML:  "<p>{{len .Reservations}} reservations alerting</p>",
+		TemplateResolved:    "{{.Name}} resolved",
+		TemplateDigest:      "{{/* digest */}}digest",
+		TemplateRightsizing: "{{/* rightsizing */}}rightsizing",
+	})
+	if err != nil {
+		t.Fatalf("failed to load templates: %v", err)
+	}
+	return templates
+}
+
+func testEmailNotifier(t *testing.T, server *fakeSMTPServer, security string, username string) *EmailNotifier {
+	notifier, err := NewEmailNotifier("email", EmailConfig{
+		Host:     "127.0.0.1",
+		Port:     server.port(),
+		Security: security,
+		Username: username,
+		Password: func() string { return "secret" },
+		From:     "alerts@example.com",
+		To:       []string{"ops@example.com", "oncall@example.com"},
+	}, testTemplates(t), DeliveryPolicy{MaxAttempts: 2, InitialBackoff: Duration{time.Millisecond}})
+	if err != nil {
+		t.Fatalf("failed to create notifier: %v", err)
+	}
+	return notifier
+}
+
+func TestEmailMultipartAlternative(t *testing.T) {
+	server := newFakeSMTPServer(t, nil)
+	notifier := testEmailNotifier(t, server, SMTPSecurityNone, "")
+
+	delivery := notifier.Notify(context.Background(), sampleState())
+	if delivery.Status != DeliveryDelivered {
+		t.Fatalf("expected delivery, got %+v", delivery)
+	}
+
+	session := server.session(t)
+	if session.from != "alerts@example.com" {
+		t.Errorf("unexpected sender %s", session.from)
+	}
+	if strings.Join(session.recipients, ",") != "ops@example.com,oncall@example.com" {
+		t.Errorf("unexpected recipients %v", session.recipients)
+	}
+	if session.username != "" {
+		t.Errorf("expected no authentication without username")
+	}
+
+	message, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(session.data)))
+	if err != nil {
+		t.Fatalf("invalid message: %v", err)
+	}
+	if message.Header.Get("To") != "ops@example.com, oncall@example.com" {
+		t.Errorf("unexpected To header %s", message.Header.Get("To"))
+	}
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative, got %s", message.Header.Get("Content-Type"))
+	}
+
+	var types, bodies []string
+	parts := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(part)
+		types = append(types, part.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}
+	if len(types) != 2 || !strings.HasPrefix(types[0], "text/plain") || !strings.HasPrefix(types[1], "text/html") {
+		t.Fatalf("expected plain-text and HTML alternatives, got %v", types)
+	}
+	if bodies[0] != "1 reservations alerting" || bodies[1] != "<p>1 reservations alerting</p>" {
+		t.Errorf("unexpected bodies %q", bodies)
+	}
+}
+
+func TestEmailStartTLSAuth(t *testing.T) {
+	serverTLS, pool := testCertificate(t)
+	server := newFakeSMTPServer(t, serverTLS)
+	notifier := testEmailNotifier(t, server, SMTPSecurityStartTLS, "user")
+	notifier.rootCAs = pool
+
+	delivery := notifier.Notify(context.Background(), sampleState())
+	if delivery.Status != DeliveryDelivered {
+		t.Fatalf("expected delivery, got %+v", delivery)
+	}
+	session := server.session(t)
+	if !session.startTLS || !session.tlsAuth {
+		t.Errorf("expected authentication after STARTTLS, got %+v", session)
+	}
+	if session.username != "user" || session.password != "secret" {
+		t.Errorf("unexpected credentials %s:%s", session.username, session.password)
+	}
+	if len(session.data) == 0 {
+		t.Errorf("expected message to be sent")
+	}
+}
+
+func TestEmailUntrustedCertificate(t *testing.T) {
+	serverTLS, _ := testCertificate(t)
+	server := newFakeSMTPServer(t, serverTLS)
+	notifier := testEmailNotifier(t, server, SMTPSecurityStartTLS, "user")
+
+	delivery := notifier.Notify(context.Background(), sampleState())
+	if delivery.Status != DeliveryFailed || delivery.Attempts != 1 {
+		t.Errorf("expected permanent failure, got %+v", delivery)
+	}
+	if session := server.session(t); session.username != "" {
+		t.Errorf("expected no credentials to be sent, got %s", session.username)
+	}
+}
+
+func TestEmailPermanentReply(t *testing.T) {
+	server := newFakeSMTPServer(t, nil)
+	server.rcptReply = "550 no such user"
+	notifier := testEmailNotifier(t, server, SMTPSecurityNone, "")
+
+	delivery := notifier.Notify(context.Background(), sampleState())
+	if delivery.Status != DeliveryFailed || delivery.Attempts != 1 || delivery.StatusCode != 550 {
+		t.Errorf("expected permanent failure, got %+v", delivery)
+	}
+}
+
+func TestEmailTransientReply(t *testing.T) {
+	server := newFakeSMTPServer(t, nil)
+	server.rcptReply = "451 try again later"
+	notifier := testEmailNotifier(t, server, SMTPSecurityNone, "")
+
+	delivery := notifier.Notify(context.Background(), sampleState())
+	if delivery.Status != DeliveryFailed || delivery.Attempts != 2 || delivery.StatusCode != 451 {
+		t.Errorf("expected retried failure, got %+v", delivery)
+	}
+}
+
+func TestEmailRejectsAuthWithoutTLS(t *testing.T) {
+	config := EmailConfig{
+		Host:     "smtp.example.com",
+		Security: SMTPSecurityNone,
+		Username: "user",
+		From:     "alerts@example.com",
+		To:       []string{"ops@example.com"},
+	}
+	_, err := NewEmailNotifier("email", config, nil, DeliveryPolicy{})
+	if err == nil {
+		t.Errorf("expected authentication without TLS to be rejected")
+	}
+
+	config.Host = "localhost"
+	_, err = NewEmailNotifier("email", config, nil, DeliveryPolicy{})
+	if err != nil {
+		t.Errorf("expected authentication to the local host to be accepted: %v", err)
+	}
+
+	config.Host = "smtp.example.com"
+	config.Username = ""
+	_, err = NewEmailNotifier("email", config, nil, DeliveryPolicy{})
+	if err != nil {
+		t.Errorf("expected unauthenticated mail without TLS to be accepted: %v", err)
+	}
+}
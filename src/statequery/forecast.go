@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"math"
+	"time"
+)
+
+// Minimum number of samples to fit a trend on
+const minForecastSamples = 3
+
+// Type for the utilization forecast of a single reservation
+type Forecast struct {
+	Samples              int        `json:"samples"`
+	Trend                float64    `json:"trend"`
+	Projected            float64    `json:"projected"`
+	Horizon              string     `json:"horizon"`
+	SaturationAt         *time.Time `json:"saturation_at,omitempty"`
+	AdditionalSlots      int        `json:"additional_slots"`
+	EarlyWarning         bool       `json:"early_warning"`
+	AdditionalHourlyCost float64    `json:"additional_hourly_cost,omitempty"`
+}
+
+// Forecast utilization per reservation by fitting a linear trend over the history of
+// archived states and the current state. Flags an early warning for reservations,
+// which are not breaching their threshold yet, but are projected to do so within
+// the horizon.
+func (state *State) ComputeForecasts(history []*State, threshold float64, horizon time.Duration) {
+	now := state.Timestamp
+	if now.IsZero() {
+		now = time.Now().UTC()
+	}
+
+	for id, reservation := range state.Reservations {
+		// Collect samples as (hours relative to now, utilization factor)
+		var hours, values []float64
+		for _, past := range history {
+			previous, ok := past.Reservations[id]
+			if !ok || !past.Timestamp.Before(now) {
+				continue
+			}
+			hours = append(hours, past.Timestamp.Sub(now).Hours())
+			values = append(values, previous.UtilizationFactor())
+		}
+		hours = append(hours, 0)
+		values = append(values, reservation.UtilizationFactor())
+
+		if len(values) < minForecastSamples {
+			continue
+		}
+
+		// Least squares fit, the intercept is the trend's utilization now
+		slope, intercept := fitLinear(hours, values)
+		forecast := &Forecast{
+			Samples:   len(values),
+			Trend:     slope,
+			Projected: math.Max(0, intercept+slope*horizon.Hours()),
+			Horizon:   horizon.String(),
+		}
+
+		// Project when the trend crosses the threshold
+		if slope > 0 {
+			crossing := (threshold - intercept) / slope
+			if crossing <= horizon.Hours() {
+				at := now.Add(time.Duration(math.Max(0, crossing) * float64(time.Hour)))
+				forecast.SaturationAt = &at
+				forecast.EarlyWarning = !reservation.ThresholdBreached
+			}
+		}
+
+		// Slots needed to keep the projected usage below the threshold
+		if threshold > 0 {
+			needed := forecast.Projected*reservation.Capacity()/threshold - reservation.Capacity()
+			if needed > 0 {
+				forecast.AdditionalSlots = int(math.Ceil(needed))
+			}
+		}
+
+		reservation.Forecast = forecast
+		state.Reservations[id] = reservation
+	}
+}
+
+// Fit y = slope * x + intercept by ordinary least squares
+func fitLinear(x []float64, y []float64) (float64, float64) {
+	n := float64(len(x))
+	var sumX, sumY, sumXX, sumXY float64
+	for i := range x {
+		sumX += x[i]
+		sumY += y[i]
+		sumXX += x[i] * x[i]
+		sumXY += x[i] * y[i]
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		// All samples at the same time, no trend
+		return 0, sumY / n
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	intercept := (sumY - slope*sumX) / n
+	return slope, intercept
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	cloudassetSDK "google.golang.org/api/cloudasset/v1"
+	cloudresourcemanagerSDK "google.golang.org/api/cloudresourcemanager/v3"
+)
+
+// Resolves an assignee (project, folder or organization) to all of its descendant
+// project IDs. Results for folders and organizations are kept in the Cache.
+// Projects are resolved to their parent folder or organization, e.g. 'folders/123'.
+type HierarchyResolver interface {
+	Children(ctx context.Context, resourceType string, resourceName string) ([]string, error)
+	Parent(ctx context.Context, project string) (string, error)
+}
+
+// Create a hierarchy resolver of the given kind, either 'resourcemanager' (default)
+// or 'assetinventory'.
+func NewHierarchyResolver(ctx context.Context, kind string, cache *Cache) (HierarchyResolver, error) {
+	switch kind {
+	case "", "resourcemanager":
+		client, err := cloudresourcemanagerSDK.NewService(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &resourceManagerResolver{client: client, cache: cache}, nil
+	case "assetinventory":
+		client, err := cloudassetSDK.NewService(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &assetInventoryResolver{client: client, cache: cache}, nil
+	default:
+		return nil, fmt.Errorf("unknown hierarchy resolver: %s", kind)
+	}
+}
+
+// Resolver walking the hierarchy level by level through the Resource Manager API.
+// Requires folderViewer on all folders below the assignee.
+type resourceManagerResolver struct {
+	client *cloudresourcemanagerSDK.Service
+	cache  *Cache
+}
+
+// Resolve descendant projects by recursively listing folders and projects
+func (resolver *resourceManagerResolver) Children(ctx context.Context, resourceType string, resourceName string) ([]string, error) {
+	return retrieveResourceChildren(resolver.client, resolver.cache, resourceType, resourceName)
+}
+
+// Resolve the parent of a project by getting the project
+func (resolver *resourceManagerResolver) Parent(ctx context.Context, project string) (string, error) {
+	result, err := resolver.client.Projects.Get(fmt.Sprintf("projects/%s", project)).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return result.Parent, nil
+}
+
+// Resolver searching Cloud Asset Inventory for all descendant projects at once.
+// Requires cloudasset.viewer on the assignee.
+type assetInventoryResolver struct {
+	client *cloudassetSDK.Service
+	cache  *Cache
+}
+
+// Searchable attributes of project resources in Cloud Asset Inventory
+type assetProjectAttributes struct {
+	ProjectID string `json:"projectId"`
+}
+
+// Resolve descendant projects with a single (paginated) resource search
+func (resolver *assetInventoryResolver) Children(ctx context.Context, resourceType string, resourceName string) ([]string, error) {
+	// Qualified name of current parent
+	parent := fmt.Sprintf("%s/%s", resourceType, resourceName)
+
+	switch resourceType {
+	case "projects":
+		// Resource is a project, only return this particular resource
+		return []string{
+			resourceName,
+		}, nil
+	case "organizations", "folders":
+		return resolver.cache.Resolve(parent, func() ([]string, error) {
+			log.Printf("cache miss, searching asset inventory: %s\n", parent)
+
+			// Refreshes may outlive the request they were started by, so do not bind
+			// the search to its context.
+			var result []string
+			err := resolver.client.V1.SearchAllResources(parent).
+				AssetTypes("cloudresourcemanager.googleapis.com/Project").
+				Query("state:ACTIVE").
+				Pages(context.Background(), func(response *cloudassetSDK.SearchAllResourcesResponse) error {
+					for _, resource := range response.Results {
+						attributes := assetProjectAttributes{}
+						err := json.Unmarshal(resource.AdditionalAttributes, &attributes)
+						if err != nil || attributes.ProjectID == "" {
+							log.Printf("skipping project without ID: %s\n", resource.Name)
+							continue
+						}
+						result = append(result, attributes.ProjectID)
+					}
+					return nil
+				})
+			if err != nil {
+				return nil, err
+			}
+			return result, nil
+		})
+	default:
+		return nil, fmt.Errorf("unexpected assignee resource type: %s", resourceType)
+	}
+}
+
+// Resolve the parent of a project by searching the project resource itself
+func (resolver *assetInventoryResolver) Parent(ctx context.Context, project string) (string, error) {
+	response, err := resolver.client.V1.SearchAllResources(fmt.Sprintf("projects/%s", project)).
+		AssetTypes("cloudresourcemanager.googleapis.com/Project").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return "", err
+	}
+	for _, resource := range response.Results {
+		if resource.ParentFullResourceName != "" {
+			return strings.TrimPrefix(resource.ParentFullResourceName, "//cloudresourcemanager.googleapis.com/"), nil
+		}
+	}
+	return "", fmt.Errorf("parent of project not found: %s", project)
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	storageSDK "cloud.google.com/go/storage"
+	iterator "google.golang.org/api/iterator"
+)
+
+// Maximum number of state dumps read concurrently
+const historyConcurrency = 16
+
+// Single point of a utilization time series
+type HistoryPoint struct {
+	Timestamp   time.Time          `json:"timestamp"`
+	Utilization map[string]float64 `json:"utilization"`
+}
+
+// Load all states archived since the given time from the bucket, oldest first
+func LoadHistory(ctx context.Context, bucket string, since time.Time) ([]*State, error) {
+	var history []*State
+	err := WalkHistory(ctx, bucket, since, func(state *State) {
+		history = append(history, state)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Timestamp.Before(history[j].Timestamp)
+	})
+	return history, nil
+}
+
+// Call fn for each state archived since the given time, in no particular order.
+// Calls are serialized, but states are not kept in memory beyond each call, which
+// allows processing long windows of history.
+func WalkHistory(ctx context.Context, bucket string, since time.Time, fn func(state *State)) error {
+	if bucket == "" {
+		return fmt.Errorf("bucket for state dumps not configured")
+	}
+
+	client, err := storageSDK.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Select dumps by the timestamp embedded in their object name
+	var objects []string
+	var stamps []time.Time
+	it := client.Bucket(bucket).Objects(ctx, &storageSDK.Query{Prefix: "state-"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		stamp, err := parseDumpTimestamp(attrs.Name)
+		if err != nil {
+			log.Printf("skipping unexpected object in state bucket: %s\n", attrs.Name)
+			continue
+		}
+		if stamp.Before(since) {
+			continue
+		}
+		objects = append(objects, attrs.Name)
+		stamps = append(stamps, stamp)
+	}
+
+	// Create sync for concurrent invokations, bounded by a semaphore
+	var mutex sync.Mutex
+	semaphore := make(chan struct{}, historyConcurrency)
+	var wg sync.WaitGroup
+	wg.Add(len(objects))
+	for i := range objects {
+		go func(i int) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			state := &State{}
+			_, err := readObject(ctx, client, bucket, objects[i], state)
+			if err != nil {
+				log.Printf("failed to read state dump %s: %v\n", objects[i], err)
+				return
+			}
+			// Dumps from older versions do not carry their own timestamp
+			if state.Timestamp.IsZero() {
+				state.Timestamp = stamps[i]
+			}
+
+			mutex.Lock()
+			fn(state)
+			mutex.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// Reduce a history of states to a utilization time series per reservation
+func Series(history []*State) []HistoryPoint {
+	points := make([]HistoryPoint, 0, len(history))
+	for _, state := range history {
+		point := HistoryPoint{
+			Timestamp:   state.Timestamp,
+			Utilization: make(map[string]float64, len(state.Reservations)),
+		}
+		for id, reservation := range state.Reservations {
+			point.Utilization[id] = reservation.UtilizationFactor()
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// Parse the timestamp from a state dump object name (state-<unix>.json)
+func parseDumpTimestamp(object string) (time.Time, error) {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(object, "state-"), ".json")
+	seconds, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
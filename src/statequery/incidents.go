@@ -0,0 +1,283 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	storageSDK "cloud.google.com/go/storage"
+)
+
+// Object in the state bucket holding all open incidents
+const incidentsObject = "alerts.json"
+
+// Kinds of alert transitions
+const (
+	TransitionFiring   = "firing"
+	TransitionChanged  = "changed"
+	TransitionResolved = "resolved"
+)
+
+// Ongoing alert on a reservation, tracked across runs
+type Incident struct {
+	Reservation string    `json:"reservation"`
+	Severity    string    `json:"severity"`
+	Since       time.Time `json:"since"`
+	Updated     time.Time `json:"updated"`
+
+	// Acknowledged incidents are not notified again until their severity changes
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+
+	// Threads of the incident per notifier, updated until it resolves
+	Threads map[string]Thread `json:"threads,omitempty"`
+}
+
+// Change of the alert status of a reservation since the previous run
+type Transition struct {
+	Reservation string    `json:"reservation"`
+	Name        string    `json:"name"`
+	Location    string    `json:"location"`
+	Status      string    `json:"status"`
+	Severity    string    `json:"severity"`
+	Previous    string    `json:"previous"`
+	Utilization float64   `json:"utilization"`
+	Since       time.Time `json:"since"`
+	Timestamp   time.Time `json:"timestamp"`
+
+	// Threads of resolved incidents per notifier
+	Threads map[string]Thread `json:"-"`
+}
+
+// Stored form of all open incidents
+type incidentDocument struct {
+	Incidents map[string]Incident `json:"incidents"`
+}
+
+// Open incidents persisted in the state bucket, or kept in memory if no bucket is
+// configured. Updates are conditional on the object generation.
+type IncidentStore struct {
+	client *storageSDK.Client
+	bucket string
+
+	// Incidents of the in-memory store
+	mutex  sync.Mutex
+	memory map[string]Incident
+}
+
+// Create an incident store in the given bucket, or in memory if it is empty
+func NewIncidentStore(ctx context.Context, bucket string) (*IncidentStore, error) {
+	store := &IncidentStore{bucket: bucket, memory: make(map[string]Incident)}
+	if bucket == "" {
+		return store, nil
+	}
+
+	client, err := storageSDK.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	store.client = client
+	return store, nil
+}
+
+// List all open incidents by reservation ID
+func (store *IncidentStore) List(ctx context.Context) (map[string]Incident, error) {
+	if store.client == nil {
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		return copyIncidents(store.memory), nil
+	}
+
+	document := incidentDocument{}
+	_, err := readObject(ctx, store.client, store.bucket, incidentsObject, &document)
+	if err != nil {
+		return nil, err
+	}
+	if document.Incidents == nil {
+		document.Incidents = make(map[string]Incident)
+	}
+	return document.Incidents, nil
+}
+
+// Apply a modification to the open incidents, retrying on concurrent modifications
+func (store *IncidentStore) update(ctx context.Context, modify func(map[string]Incident) error) error {
+	if store.client == nil {
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		return modify(store.memory)
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		document := incidentDocument{}
+		generation, err := readObject(ctx, store.client, store.bucket, incidentsObject, &document)
+		if err != nil {
+			return err
+		}
+		if document.Incidents == nil {
+			document.Incidents = make(map[string]Incident)
+		}
+
+		err = modify(document.Incidents)
+		if err != nil {
+			return err
+		}
+
+		_, err = writeObject(ctx, store.client, store.bucket, incidentsObject, document, generation)
+		if err == ErrVersionConflict {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("giving up updating incidents after repeated conflicts")
+}
+
+// Compare the severity of the reservations of a state with the open incidents,
+// record the transitions in the state and update the incidents accordingly.
+// Suppressed reservations are tracked like any other, so silencing an incident
+// neither resolves it nor starts a new one once the silence ends. Reservations
+// missing from the state (e.g. deleted ones) are resolved as well.
+func (store *IncidentStore) Track(ctx context.Context, state *State) error {
+	var transitions []Transition
+	err := store.update(ctx, func(incidents map[string]Incident) error {
+		transitions = nil
+
+		for id, reservation := range state.Reservations {
+			// Suppression only filters deliveries, so muted breaches keep their incident
+			severity := reservation.Severity()
+			incident, open := incidents[id]
+
+			transition := Transition{
+				Reservation: id,
+				Name:        reservation.Name,
+				Location:    reservation.Location,
+				Severity:    severity,
+				Previous:    incident.Severity,
+				Utilization: reservation.UtilizationFactor(),
+				Since:       incident.Since,
+				Timestamp:   state.Timestamp,
+			}
+			switch {
+			case !open && severity == "":
+				continue
+			case !open:
+				transition.Status = TransitionFiring
+				transition.Since = state.Timestamp
+				incident = Incident{Reservation: id, Since: state.Timestamp}
+			case severity == "":
+				transition.Status = TransitionResolved
+				transition.Threads = incident.Threads
+				delete(incidents, id)
+				transitions = append(transitions, transition)
+				continue
+			case severity != incident.Severity:
+				transition.Status = TransitionChanged
+				incident.AcknowledgedBy = ""
+				incident.AcknowledgedAt = nil
+			}
+
+			incident.Severity = severity
+			incident.Updated = state.Timestamp
+			incidents[id] = incident
+
+			// Carry acknowledgements over into the state, so they are not notified again,
+			// and the start of the incident, which threads its notifications
+			since := incident.Since
+			reservation.AcknowledgedBy = incident.AcknowledgedBy
+			reservation.AlertingSince = &since
+			reservation.Threads = incident.Threads
+			state.Reservations[id] = reservation
+			if transition.Status != "" {
+				transitions = append(transitions, transition)
+			}
+		}
+
+		// Resolve incidents of reservations, which no longer exist
+		for id, incident := range incidents {
+			if _, ok := state.Reservations[id]; ok {
+				continue
+			}
+			transitions = append(transitions, Transition{
+				Reservation: id,
+				Status:      TransitionResolved,
+				Previous:    incident.Severity,
+				Since:       incident.Since,
+				Timestamp:   state.Timestamp,
+				Threads:     incident.Threads,
+			})
+			delete(incidents, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(transitions, func(i, j int) bool {
+		return transitions[i].Reservation < transitions[j].Reservation
+	})
+	state.Transitions = transitions
+	return nil
+}
+
+// Acknowledge the open incident of a reservation
+func (store *IncidentStore) Acknowledge(ctx context.Context, id string, user string) error {
+	return store.update(ctx, func(incidents map[string]Incident) error {
+		incident, ok := incidents[id]
+		if !ok {
+			return fmt.Errorf("no open alert on reservation %s", id)
+		}
+		now := time.Now().UTC()
+		incident.AcknowledgedBy = user
+		incident.AcknowledgedAt = &now
+		incidents[id] = incident
+		return nil
+	})
+}
+
+// Record the threads a notifier started on open incidents, by reservation ID.
+// Threads of incidents resolved in the meantime are dropped.
+func (store *IncidentStore) SaveThreads(ctx context.Context, notifier string, threads map[string]Thread) error {
+	return store.update(ctx, func(incidents map[string]Incident) error {
+		for id, thread := range threads {
+			incident, ok := incidents[id]
+			if !ok {
+				continue
+			}
+			// Copy the threads, which are shared with the state of the run
+			updated := map[string]Thread{notifier: thread}
+			for name, existing := range incident.Threads {
+				if name != notifier {
+					updated[name] = existing
+				}
+			}
+			incident.Threads = updated
+			incidents[id] = incident
+		}
+		return nil
+	})
+}
+
+// Copy incidents, so callers can not modify the in-memory store
+func copyIncidents(incidents map[string]Incident) map[string]Incident {
+	result := make(map[string]Incident, len(incidents))
+	for id, incident := range incidents {
+		result[id] = incident
+	}
+	return result
+}
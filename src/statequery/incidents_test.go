@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// State of a single reservation at the given minute of a test run
+func trackedState(minute int, breached bool, suppressed bool) *State {
+	return &State{
+		Timestamp: time.Date(2021, 6, 1, 12, minute, 0, 0, time.UTC),
+		Reservations: map[string]Reservation{
+			"US.r1": {
+				Name:              "r1",
+				Location:          "US",
+				Slots:             100,
+				TotalUsage:        95,
+				ThresholdBreached: breached,
+				Suppressed:        suppressed,
+			},
+		},
+	}
+}
+
+// Track a state, failing the test on errors
+func track(t *testing.T, store *IncidentStore, state *State) []Transition {
+	t.Helper()
+	err := store.Track(context.Background(), state)
+	if err != nil {
+		t.Fatalf("Track() failed: %v", err)
+	}
+	return state.Transitions
+}
+
+func TestTrackOpensAndResolves(t *testing.T) {
+	store, _ := NewIncidentStore(context.Background(), "")
+
+	transitions := track(t, store, trackedState(0, true, false))
+	if len(transitions) != 1 || transitions[0].Status != TransitionFiring || transitions[0].Severity != SeverityCritical {
+		t.Fatalf("expected a critical firing transition, got %+v", transitions)
+	}
+
+	transitions = track(t, store, trackedState(1, true, false))
+	if len(transitions) != 0 {
+		t.Errorf("expected no transitions while breaching, got %+v", transitions)
+	}
+
+	transitions = track(t, store, trackedState(2, false, false))
+	if len(transitions) != 1 || transitions[0].Status != TransitionResolved {
+		t.Fatalf("expected a resolved transition, got %+v", transitions)
+	}
+	incidents, _ := store.List(context.Background())
+	if len(incidents) != 0 {
+		t.Errorf("expected no open incidents, got %+v", incidents)
+	}
+}
+
+func TestTrackSilencedIncident(t *testing.T) {
+	store, _ := NewIncidentStore(context.Background(), "")
+	track(t, store, trackedState(0, true, false))
+	since := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// Silencing the breach keeps the incident open without any transition
+	state := trackedState(1, true, true)
+	transitions := track(t, store, state)
+	if len(transitions) != 0 {
+		t.Fatalf("expected no transitions when silenced, got %+v", transitions)
+	}
+	if alertingSince := state.Reservations["US.r1"].AlertingSince; alertingSince == nil || !alertingSince.Equal(since) {
+		t.Errorf("expected silenced reservation alerting since %v, got %v", since, alertingSince)
+	}
+	incidents, _ := store.List(context.Background())
+	if incident, ok := incidents["US.r1"]; !ok || !incident.Since.Equal(since) {
+		t.Errorf("expected the incident to stay open since %v, got %+v", since, incidents)
+	}
+
+	// Ending the silence continues the same incident
+	state = trackedState(2, true, false)
+	transitions = track(t, store, state)
+	if len(transitions) != 0 {
+		t.Fatalf("expected no transitions when the silence ends, got %+v", transitions)
+	}
+	if alertingSince := state.Reservations["US.r1"].AlertingSince; alertingSince == nil || !alertingSince.Equal(since) {
+		t.Errorf("expected the incident to continue since %v, got %v", since, alertingSince)
+	}
+}
+
+func TestTrackSilencedResolution(t *testing.T) {
+	store, _ := NewIncidentStore(context.Background(), "")
+	track(t, store, trackedState(0, true, false))
+
+	// A silenced incident still resolves once its breach is over
+	transitions := track(t, store, trackedState(1, false, true))
+	if len(transitions) != 1 || transitions[0].Status != TransitionResolved {
+		t.Fatalf("expected a resolved transition, got %+v", transitions)
+	}
+}
@@ -16,7 +16,6 @@ package statequery
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"sync"
 
@@ -32,7 +31,7 @@ func (state *State) RetrieveJobs(ctx context.Context) error {
 		log.Printf("failed to initialize BigQuery client: %v\n", err)
 	}
 
-	for _, reservation := range state.Reservations {
+	for id, reservation := range state.Reservations {
 
 		// Create sync & comms for concurrent invokations
 		ch := make(chan Job)
@@ -55,7 +54,6 @@ func (state *State) RetrieveJobs(ctx context.Context) error {
 		for job := range ch {
 			reservation.Jobs = append(reservation.Jobs, job)
 		}
-		id := fmt.Sprintf("%s.%s", reservation.Location, reservation.Name)
 		state.Reservations[id] = reservation
 	}
 	return nil
@@ -117,16 +115,23 @@ func retrieveJobsProject(ctx context.Context, client *bigquerySDK.Service, proje
 			// Compute slot usage by eliminating time
 			slots := float64(slotMillis) / float64(runtimeMillis)
 
-			// Double check if the job's reservation matches the one we are looking for
-			fullReservationId := fmt.Sprintf("%s:%s.%s", project, reservation.Location, reservation.Name)
-			if current.Statistics.ReservationId != fullReservationId {
-				log.Printf("warn: detected missing reservation ID or mismatch: expected %s, found %s, on job %s", fullReservationId, current.Statistics.ReservationId, job.JobReference.JobId)
+			// Double check if the job's reservation matches the one we are looking for.
+			// Jobs name the admin project rather than their own in the reservation ID.
+			if current.Statistics.ReservationId != reservation.NamespacedID() {
+				log.Printf("warn: detected missing reservation ID or mismatch: expected %s, found %s, on job %s\n", reservation.NamespacedID(), current.Statistics.ReservationId, job.JobReference.JobId)
 			}
 
 			// All good. Push job down the channel.
 			ch <- Job{
-				Name:  current.Id,
-				Usage: slots,
+				Name:           current.Id,
+				ID:             current.JobReference.JobId,
+				Project:        project,
+				Location:       current.JobReference.Location,
+				User:           current.UserEmail,
+				Labels:         current.Configuration.Labels,
+				Usage:          slots,
+				RuntimeMillis:  runtimeMillis,
+				BytesProcessed: stats.TotalBytesProcessed,
 			}
 		}
 	}
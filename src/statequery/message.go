@@ -15,50 +15,111 @@
 package statequery
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"log"
-	"net/http"
-	"text/template"
+	neturl "net/url"
 )
 
-// Renders the state into the text-template at './templates/message.template'
-func (state *State) RenderMessage() (string, error) {
-	template, err := template.ParseFiles("templates/message.template")
-	if err != nil {
-		return "", err
+// Destination for alerts. Notifiers receive a state holding only the reservations
+// routed to them, and report the outcome of delivering it.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, state *State) Delivery
+}
+
+// Notifier posting the rendered message to a Slack or Google Chat incoming webhook
+type WebhookNotifier struct {
+	name      string
+	url       func() string
+	templates *Templates
+	policy    DeliveryPolicy
+
+	// Action buttons added to Slack messages, if set
+	Actions *AlertActions
+	// Post every reservation separately, threaded by the key of its incident, as
+	// supported by Google Chat webhooks
+	Threaded bool
+}
+
+// Create a webhook notifier. The URL is resolved on every notification, so rotated
+// secrets are picked up without a restart.
+func NewWebhookNotifier(name string, url func() string, templates *Templates, policy DeliveryPolicy) *WebhookNotifier {
+	return &WebhookNotifier{name: name, url: url, templates: templates, policy: policy}
+}
+
+// Name of the notifier instance
+func (notifier *WebhookNotifier) Name() string {
+	return notifier.name
+}
+
+// Render the state and post it to the webhook
+func (notifier *WebhookNotifier) Notify(ctx context.Context, state *State) Delivery {
+	// Skip if webhook URL is not configured
+	url := notifier.url()
+	if !webhookConfigured(url) {
+		log.Printf("webhook for %s not configured, skipping...\n", notifier.name)
+		delivery := NewDelivery(notifier.name, state, 0, nil)
+		delivery.Status = DeliverySkipped
+		return delivery
+	}
+	log.Printf("publishing message to %s\n", notifier.name)
+
+	if notifier.Threaded {
+		return notifier.notifyThreads(ctx, url, state)
 	}
 
-	var writer bytes.Buffer
-	err = template.Execute(&writer, state)
+	// Render message from template
+	message, err := notifier.templates.Firing(state)
 	if err != nil {
-		return "", err
+		return NewDelivery(notifier.name, state, 0, err)
+	}
+
+	// POST message in payload format accepted by Slack and Google Chat
+	payload := map[string]interface{}{"text": message}
+	if notifier.Actions != nil {
+		payload["blocks"] = notifier.Actions.SlackBlocks(state, message)
 	}
-	return writer.String(), nil
+	attempts, err := postJSON(ctx, url, nil, payload, notifier.policy)
+	return NewDelivery(notifier.name, state, attempts, err)
 }
 
-// Send message to configured webhooks
-func SendMessage(hooks map[string]string, message string) error {
-	for service, url := range hooks {
-		// Skip if webhook URL is not configured
-		if url == "" {
-			log.Printf("webhook for %s not configured, skipping...\n", service)
-			continue
-		}
-		log.Printf("publishing message to %s\n", service)
+// Post every reservation to the thread of its incident, starting it on first use.
+// Thread keys are derived from the incidents, so no threads are recorded.
+func (notifier *WebhookNotifier) notifyThreads(ctx context.Context, url string, state *State) Delivery {
+	parsed, err := neturl.Parse(url)
+	if err != nil {
+		return NewDelivery(notifier.name, state, 0, err)
+	}
+	query := parsed.Query()
+	query.Set("messageReplyOption", "REPLY_MESSAGE_FALLBACK_TO_NEW_THREAD")
+	parsed.RawQuery = query.Encode()
 
-		// Serialize message into payload format accepted by Slack and Google Chat
-		payload := map[string]string{"text": message}
-		data, err := json.Marshal(payload)
-		if err != nil {
-			return err
+	return notifyThreads(ctx, notifier.name, notifier.templates, state, func(ctx context.Context, id string, single *State, message string, thread Thread, threaded bool) (Thread, int, error) {
+		payload := map[string]interface{}{
+			"text":   message,
+			"thread": map[string]string{"threadKey": ThreadKey(id, single.Reservations[id])},
 		}
+		attempts, err := postJSON(ctx, parsed.String(), nil, payload, notifier.policy)
+		return Thread{}, attempts, err
+	})
+}
 
-		// POST message to chat API.
-		_, err = http.Post(url, "application/json", bytes.NewBuffer(data))
-		if err != nil {
-			log.Printf("failed to push message to %s: %v\n", service, err)
-		}
+// Render the report and post it to the webhook
+func (notifier *WebhookNotifier) NotifyReport(ctx context.Context, report Report) Delivery {
+	state := report.state()
+	url := notifier.url()
+	if !webhookConfigured(url) {
+		log.Printf("webhook for %s not configured, skipping...\n", notifier.name)
+		delivery := NewDelivery(notifier.name, state, 0, nil)
+		delivery.Status = DeliverySkipped
+		return delivery
+	}
+	log.Printf("publishing report to %s\n", notifier.name)
+
+	message, err := report.render(notifier.templates)
+	if err != nil {
+		return NewDelivery(notifier.name, state, 0, err)
 	}
-	return nil
+	attempts, err := postJSON(ctx, url, nil, map[string]interface{}{"text": message}, notifier.policy)
+	return NewDelivery(notifier.name, state, attempts, err)
 }
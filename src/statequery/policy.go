@@ -0,0 +1,182 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	bigquerySDK "google.golang.org/api/bigquery/v2"
+)
+
+// Actions taken on runaway jobs
+const (
+	RunawayActionNone      = "none"
+	RunawayActionDryRun    = "dry-run"
+	RunawayActionProtected = "protected"
+	RunawayActionCancelled = "cancelled"
+	RunawayActionFailed    = "failed"
+)
+
+// Policy identifying runaway jobs, which consume an outsized share of a reservation.
+// Limits left at zero are not enforced. Cancellation requires both Cancel to be set
+// and DryRun to be explicitly disabled.
+type RunawayPolicy struct {
+	MaxSlotShare      float64   `json:"max_slot_share"`
+	MaxRuntime        Duration  `json:"max_runtime"`
+	MaxBytesProcessed int64     `json:"max_bytes_processed"`
+	Cancel            bool      `json:"cancel"`
+	DryRun            *bool     `json:"dry_run"`
+	Allow             JobFilter `json:"allow"`
+	Deny              JobFilter `json:"deny"`
+}
+
+// Filter matching jobs by project, user or any of the given labels
+type JobFilter struct {
+	Projects []string          `json:"projects"`
+	Users    []string          `json:"users"`
+	Labels   map[string]string `json:"labels"`
+}
+
+// Type for jobs violating the runaway policy
+type RunawayJob struct {
+	Job
+	Reasons []string `json:"reasons"`
+	Action  string   `json:"action"`
+}
+
+// Whether the filter has no criteria
+func (filter JobFilter) empty() bool {
+	return len(filter.Projects) == 0 && len(filter.Users) == 0 && len(filter.Labels) == 0
+}
+
+// Whether a job matches any criteria of the filter
+func (filter JobFilter) matches(job Job) bool {
+	for _, project := range filter.Projects {
+		if project == job.Project {
+			return true
+		}
+	}
+	for _, user := range filter.Users {
+		if user == job.User {
+			return true
+		}
+	}
+	for key, value := range filter.Labels {
+		if label, ok := job.Labels[key]; ok && label == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether jobs are only reported instead of cancelled
+func (policy *RunawayPolicy) dryRun() bool {
+	return !policy.Cancel || policy.DryRun == nil || *policy.DryRun
+}
+
+// Copy of the policy reporting the jobs it would cancel without cancelling them,
+// e.g. for scans triggered by chat users
+func (policy *RunawayPolicy) ReadOnly() *RunawayPolicy {
+	readOnly := *policy
+	dryRun := true
+	readOnly.DryRun = &dryRun
+	return &readOnly
+}
+
+// Whether a job may be cancelled. Denied jobs are never cancelled, and if an allow
+// list is given, only jobs matching it are.
+func (policy *RunawayPolicy) cancellable(job Job) bool {
+	if policy.Deny.matches(job) {
+		return false
+	}
+	return policy.Allow.empty() || policy.Allow.matches(job)
+}
+
+// Reasons for which a job violates the policy, if any
+func (policy *RunawayPolicy) violations(job Job, reservation Reservation) []string {
+	var reasons []string
+
+	// Share of the reservation's capacity, or of its usage for reservations without any
+	capacity := reservation.Capacity()
+	if capacity == 0 {
+		capacity = reservation.TotalUsage
+	}
+	if policy.MaxSlotShare > 0 && capacity > 0 && job.Usage/capacity > policy.MaxSlotShare {
+		reasons = append(reasons, fmt.Sprintf("using %.0f%% of reservation slots", job.Usage/capacity*100))
+	}
+
+	runtime := time.Duration(job.RuntimeMillis) * time.Millisecond
+	if policy.MaxRuntime.Duration > 0 && runtime > policy.MaxRuntime.Duration {
+		reasons = append(reasons, fmt.Sprintf("running for %v", runtime.Round(time.Second)))
+	}
+
+	if policy.MaxBytesProcessed > 0 && job.BytesProcessed > policy.MaxBytesProcessed {
+		reasons = append(reasons, fmt.Sprintf("processed %d bytes", job.BytesProcessed))
+	}
+	return reasons
+}
+
+// Evaluate the runaway policy over all jobs of each reservation, and cancel violating
+// jobs if the policy allows to.
+func (state *State) EvaluateRunaways(ctx context.Context, policy *RunawayPolicy) error {
+	var client *bigquerySDK.Service
+	if !policy.dryRun() {
+		var err error
+		client, err = bigquerySDK.NewService(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	for id, reservation := range state.Reservations {
+		reservation.RunawayJobs = nil
+		for _, job := range reservation.Jobs {
+			reasons := policy.violations(job, reservation)
+			if len(reasons) == 0 {
+				continue
+			}
+
+			runaway := RunawayJob{
+				Job:     job,
+				Reasons: reasons,
+				Action:  RunawayActionNone,
+			}
+			switch {
+			case !policy.Cancel:
+				// Report only
+			case !policy.cancellable(job):
+				runaway.Action = RunawayActionProtected
+			case policy.dryRun():
+				log.Printf("dry-run: would cancel runaway job %s\n", job.Name)
+				runaway.Action = RunawayActionDryRun
+			default:
+				log.Printf("cancelling runaway job %s\n", job.Name)
+				_, err := client.Jobs.Cancel(job.Project, job.ID).Location(job.Location).Context(ctx).Do()
+				if err != nil {
+					log.Printf("failed to cancel job %s: %v\n", job.Name, err)
+					runaway.Action = RunawayActionFailed
+				} else {
+					runaway.Action = RunawayActionCancelled
+				}
+			}
+			reservation.RunawayJobs = append(reservation.RunawayJobs, runaway)
+		}
+		state.Reservations[id] = reservation
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Location key of prices applying to all locations without a price of their own
+const AnyLocation = "*"
+
+// Prices per slot-hour (USD) by edition and location
+type PriceTable map[string]map[string]float64
+
+// Pay-as-you-go list prices in the US multi-region, used for all locations unless
+// overridden. Regional prices and commitment discounts differ, so configure them
+// for accurate estimates.
+var DefaultPrices = PriceTable{
+	"STANDARD":        {AnyLocation: 0.04},
+	"ENTERPRISE":      {AnyLocation: 0.06},
+	"ENTERPRISE_PLUS": {AnyLocation: 0.10},
+}
+
+// Overlay prices onto a copy of the table. Editions are matched case-insensitively
+// and locations are merged, so overrides may set single locations only.
+func (table PriceTable) Merge(overrides PriceTable) PriceTable {
+	merged := make(PriceTable)
+	for _, layer := range []PriceTable{table, overrides} {
+		for edition, locations := range layer {
+			edition = strings.ToUpper(edition)
+			if merged[edition] == nil {
+				merged[edition] = make(map[string]float64)
+			}
+			for location, price := range locations {
+				merged[edition][location] = price
+			}
+		}
+	}
+	return merged
+}
+
+// Validate that no prices are negative
+func (table PriceTable) Validate() error {
+	for edition, locations := range table {
+		for location, price := range locations {
+			if price < 0 {
+				return fmt.Errorf("negative price of %s in %s: %v", edition, location, price)
+			}
+		}
+	}
+	return nil
+}
+
+// Price per slot-hour of an edition in a location, falling back to the price for
+// any location. Locations are matched case-insensitively, as configured locations
+// may be e.g. 'US' or 'us'.
+func (table PriceTable) Price(edition string, location string) (float64, bool) {
+	locations, ok := table[strings.ToUpper(edition)]
+	if !ok {
+		return 0, false
+	}
+	for key, price := range locations {
+		if strings.EqualFold(key, location) {
+			return price, true
+		}
+	}
+	price, ok := locations[AnyLocation]
+	return price, ok
+}
+
+// Estimate the hourly cost of the baseline slots of each reservation, and of the
+// additional slots recommended for breached reservations and by forecasts.
+// Reservations without edition, i.e. legacy flat-rate ones, or without a
+// configured price are left without.
+func (state *State) EstimateCosts(table PriceTable) {
+	for id, reservation := range state.Reservations {
+		if reservation.Edition == "" {
+			continue
+		}
+		price, ok := table.Price(reservation.Edition, reservation.Location)
+		if !ok {
+			continue
+		}
+
+		reservation.HourlyCost = reservation.Slots * price
+		reservation.AdditionalHourlyCost = float64(reservation.AdditionalSlots) * price
+		if reservation.Forecast != nil {
+			reservation.Forecast.AdditionalHourlyCost = float64(reservation.Forecast.AdditionalSlots) * price
+		}
+		state.Reservations[id] = reservation
+	}
+}
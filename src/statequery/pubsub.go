@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	option "google.golang.org/api/option"
+	pubsubSDK "google.golang.org/api/pubsub/v1"
+)
+
+// Types of published events, set as 'type' attribute
+const (
+	EventState = "state"
+	EventAlert = "alert"
+)
+
+// Ordering key of state events, so consumers receive runs in order
+const stateOrderingKey = "state"
+
+// Client publishing requests to a topic, substituted by a fake in tests
+type topicClient interface {
+	publish(ctx context.Context, topic string, request *pubsubSDK.PublishRequest) error
+}
+
+// Topic client of the Pub/Sub REST API
+type serviceClient struct {
+	service *pubsubSDK.Service
+}
+
+func (client *serviceClient) publish(ctx context.Context, topic string, request *pubsubSDK.PublishRequest) error {
+	_, err := client.service.Projects.Topics.Publish(topic, request).Context(ctx).Do()
+	return err
+}
+
+// Publishes state snapshots and alert transitions to a Pub/Sub topic
+type Publisher struct {
+	client topicClient
+	topic  string
+}
+
+// Create a publisher for the given topic (projects/<project>/topics/<topic>).
+// Honors PUBSUB_EMULATOR_HOST to publish to a local emulator.
+func NewPublisher(ctx context.Context, topic string) (*Publisher, error) {
+	var opts []option.ClientOption
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		opts = append(opts, option.WithEndpoint(fmt.Sprintf("http://%s/", host)), option.WithoutAuthentication())
+	}
+
+	service, err := pubsubSDK.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{client: &serviceClient{service: service}, topic: topic}, nil
+}
+
+// Publish the full state of a run, followed by an event per alert transition.
+// Alert events are ordered per reservation. Pub/Sub requires all messages of a
+// request to share their ordering key, so each key is published separately.
+func (publisher *Publisher) Publish(ctx context.Context, state *State) error {
+	alerting := 0
+	for _, reservation := range state.Reservations {
+		if reservation.Alerting() {
+			alerting++
+		}
+	}
+
+	message, err := newMessage(state, stateOrderingKey, map[string]string{
+		"type":         EventState,
+		"timestamp":    state.Timestamp.Format(time.RFC3339),
+		"reservations": strconv.Itoa(len(state.Reservations)),
+		"alerting":     strconv.Itoa(alerting),
+	})
+	if err != nil {
+		return err
+	}
+	// Publish the state event on its own, so it is not lost with failing transitions
+	log.Printf("publishing state event to %s\n", publisher.topic)
+	err = publisher.client.publish(ctx, publisher.topic, &pubsubSDK.PublishRequest{
+		Messages: []*pubsubSDK.PubsubMessage{message},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Group transitions by reservation, keeping the order of reservations
+	keys := []string{}
+	grouped := make(map[string][]*pubsubSDK.PubsubMessage)
+	for _, transition := range state.Transitions {
+		message, err := newMessage(transition, transition.Reservation, map[string]string{
+			"type":        EventAlert,
+			"reservation": transition.Reservation,
+			"location":    transition.Location,
+			"status":      transition.Status,
+			"severity":    transition.Severity,
+			"previous":    transition.Previous,
+			"timestamp":   transition.Timestamp.Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+		if _, ok := grouped[message.OrderingKey]; !ok {
+			keys = append(keys, message.OrderingKey)
+		}
+		grouped[message.OrderingKey] = append(grouped[message.OrderingKey], message)
+	}
+
+	// Keep publishing the other reservations if one fails
+	var failed error
+	for _, key := range keys {
+		log.Printf("publishing %d alert events of %s to %s\n", len(grouped[key]), key, publisher.topic)
+		err = publisher.client.publish(ctx, publisher.topic, &pubsubSDK.PublishRequest{
+			Messages: grouped[key],
+		})
+		if err != nil {
+			log.Printf("failed to publish alert events of %s: %v\n", key, err)
+			failed = err
+		}
+	}
+	return failed
+}
+
+// Encode an event as Pub/Sub message, dropping empty attributes
+func newMessage(event interface{}, orderingKey string, attributes map[string]string) (*pubsubSDK.PubsubMessage, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range attributes {
+		if value == "" {
+			delete(attributes, key)
+		}
+	}
+	return &pubsubSDK.PubsubMessage{
+		Data:        base64.StdEncoding.EncodeToString(data),
+		Attributes:  attributes,
+		OrderingKey: orderingKey,
+	}, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	pubsubSDK "google.golang.org/api/pubsub/v1"
+)
+
+// Topic client recording published requests, failing for the given ordering keys
+type fakeTopicClient struct {
+	topics   []string
+	requests []*pubsubSDK.PublishRequest
+	failing  map[string]bool
+}
+
+func (client *fakeTopicClient) publish(ctx context.Context, topic string, request *pubsubSDK.PublishRequest) error {
+	client.topics = append(client.topics, topic)
+	client.requests = append(client.requests, request)
+	if client.failing[request.Messages[0].OrderingKey] {
+		return errors.New("publish failed")
+	}
+	return nil
+}
+
+func publishedState() *State {
+	timestamp := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	return &State{
+		Timestamp: timestamp,
+		Reservations: map[string]Reservation{
+			"US.r1": {Name: "r1", Location: "US", Slots: 100},
+			"US.r2": {Name: "r2", Location: "US", Slots: 100},
+		},
+		Transitions: []Transition{
+			{Reservation: "US.r1", Location: "US", Status: "firing", Severity: "warning", Timestamp: timestamp},
+			{Reservation: "US.r2", Location: "US", Status: "firing", Severity: "critical", Timestamp: timestamp},
+			{Reservation: "US.r1", Location: "US", Status: "firing", Severity: "critical", Previous: "warning", Timestamp: timestamp},
+		},
+	}
+}
+
+func TestPublishOrderingKeys(t *testing.T) {
+	client := &fakeTopicClient{}
+	publisher := &Publisher{client: client, topic: "projects/p/topics/t"}
+	err := publisher.Publish(context.Background(), publishedState())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(client.requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(client.requests))
+	}
+	for i, request := range client.requests {
+		if client.topics[i] != "projects/p/topics/t" {
+			t.Errorf("request %d published to %s", i, client.topics[i])
+		}
+		for _, message := range request.Messages {
+			if message.OrderingKey != request.Messages[0].OrderingKey {
+				t.Errorf("request %d mixes ordering keys %s and %s", i, request.Messages[0].OrderingKey, message.OrderingKey)
+			}
+		}
+	}
+
+	state := client.requests[0].Messages
+	if len(state) != 1 || state[0].OrderingKey != stateOrderingKey {
+		t.Fatalf("expected a single state event first, got %+v", state)
+	}
+	if len(client.requests[1].Messages) != 2 || client.requests[1].Messages[0].OrderingKey != "US.r1" {
+		t.Errorf("expected both transitions of US.r1 in the second request, got %+v", client.requests[1].Messages)
+	}
+	if len(client.requests[2].Messages) != 1 || client.requests[2].Messages[0].OrderingKey != "US.r2" {
+		t.Errorf("expected the transition of US.r2 in the third request, got %+v", client.requests[2].Messages)
+	}
+
+	// Transitions of a reservation keep their order
+	var transition Transition
+	data, err := base64.StdEncoding.DecodeString(client.requests[1].Messages[1].Data)
+	if err != nil {
+		t.Fatalf("invalid message data: %v", err)
+	}
+	err = json.Unmarshal(data, &transition)
+	if err != nil {
+		t.Fatalf("invalid message data: %v", err)
+	}
+	if transition.Previous != "warning" {
+		t.Errorf("expected escalation last, got %+v", transition)
+	}
+}
+
+func TestPublishAttributes(t *testing.T) {
+	client := &fakeTopicClient{}
+	publisher := &Publisher{client: client, topic: "projects/p/topics/t"}
+	err := publisher.Publish(context.Background(), publishedState())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"type":         EventState,
+		"timestamp":    "2021-06-01T12:00:00Z",
+		"reservations": "2",
+		"alerting":     "0",
+	}
+	attributes := client.requests[0].Messages[0].Attributes
+	for key, value := range expected {
+		if attributes[key] != value {
+			t.Errorf("state attribute %s: expected %q, got %q", key, value, attributes[key])
+		}
+	}
+
+	attributes = client.requests[1].Messages[0].Attributes
+	expected = map[string]string{
+		"type":        EventAlert,
+		"reservation": "US.r1",
+		"location":    "US",
+		"status":      "firing",
+		"severity":    "warning",
+		"timestamp":   "2021-06-01T12:00:00Z",
+	}
+	for key, value := range expected {
+		if attributes[key] != value {
+			t.Errorf("alert attribute %s: expected %q, got %q", key, value, attributes[key])
+		}
+	}
+	if _, ok := attributes["previous"]; ok {
+		t.Errorf("expected empty previous attribute to be dropped")
+	}
+}
+
+func TestPublishFailingReservation(t *testing.T) {
+	client := &fakeTopicClient{failing: map[string]bool{"US.r1": true}}
+	publisher := &Publisher{client: client, topic: "projects/p/topics/t"}
+	err := publisher.Publish(context.Background(), publishedState())
+	if err == nil {
+		t.Fatalf("expected error of failing reservation")
+	}
+	if len(client.requests) != 3 {
+		t.Errorf("expected other reservations to be published, got %d requests", len(client.requests))
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import "context"
+
+// Summary posted periodically besides alerts, such as digests
+type Report interface {
+	// Render the report with the templates of a notifier
+	render(templates *Templates) (string, error)
+	// Subject line of report emails
+	subject() string
+	// State holding the reservations of the report, to report deliveries on them
+	state() *State
+}
+
+// Notifiers able to post reports, besides alerts
+type ReportNotifier interface {
+	Notifier
+	NotifyReport(ctx context.Context, report Report) Delivery
+}
@@ -26,8 +26,11 @@ import (
 	iterator "google.golang.org/api/iterator"
 )
 
-// Retrieves BQ reservations from current (admin) project and adds them to the state
-func (state *State) RetrieveReservations(ctx context.Context, project string, locations []string) error {
+// Retrieves BQ reservations from all admin projects and adds them to the state.
+// Reservations record their admin project, and are keyed by it as well if
+// namespaced, see NamespacedID. Namespacing is required with more than one admin
+// project, so reservations of the same name do not collide.
+func (state *State) RetrieveReservations(ctx context.Context, projects []string, locations []string, namespaced bool) error {
 	state.Reservations = make(map[string]Reservation)
 
 	// Create shared BQ reservations client
@@ -40,12 +43,15 @@ func (state *State) RetrieveReservations(ctx context.Context, project string, lo
 	// Create sync & comms for concurrent invokations
 	ch := make(chan Reservation)
 	var wg sync.WaitGroup
-	wg.Add(len(locations))
-
-	// Retrieve BQ reservations from every configure region/multi-region
-	for _, location := range locations {
-		// Create a per-region routine to avoid blocking on I/O during API calls
-		go retrieveReservationLocation(ctx, client, project, location, ch, &wg)
+	wg.Add(len(projects) * len(locations))
+
+	// Retrieve BQ reservations from every configure region/multi-region of every
+	// admin project
+	for _, project := range projects {
+		for _, location := range locations {
+			// Create a per-region routine to avoid blocking on I/O during API calls
+			go retrieveReservationLocation(ctx, client, project, location, ch, &wg)
+		}
 	}
 
 	go func() {
@@ -56,8 +62,7 @@ func (state *State) RetrieveReservations(ctx context.Context, project string, lo
 
 	// Read found reservations into state
 	for reservation := range ch {
-		id := fmt.Sprintf("%s.%s", reservation.Location, reservation.Name)
-		state.Reservations[id] = reservation
+		state.Reservations[reservation.stateID(namespaced)] = reservation
 	}
 
 	return nil
@@ -95,12 +100,146 @@ func retrieveReservationLocation(ctx context.Context, client *reservationSDK.Cli
 			continue
 		}
 
+		// Legacy flat-rate reservations have no edition
+		edition := ""
+		if response.Edition != reservationPB.Edition_EDITION_UNSPECIFIED {
+			edition = response.Edition.String()
+		}
+
 		log.Printf("found reservation: %s\n", response.Name)
 		// Push reservation down the channel
 		ch <- Reservation{
-			Name:     name,
-			Slots:    float64(response.SlotCapacity),
-			Location: location,
+			Name:              name,
+			Slots:             float64(response.SlotCapacity),
+			Location:          location,
+			AdminProject:      project,
+			Edition:           edition,
+			AutoscaleMaxSlots: float64(response.GetAutoscale().GetMaxSlots()),
+		}
+	}
+}
+
+// ID of the reservation in the state, e.g. 'US.r1', or 'admin:US.r1' if namespaced
+// by its admin project
+func (reservation Reservation) stateID(namespaced bool) string {
+	if !namespaced {
+		return reservationID("", reservation.Location, reservation.Name)
+	}
+	return reservation.NamespacedID()
+}
+
+// ID of the reservation qualified by its admin project, e.g. 'admin:US.r1', as
+// referenced by jobs
+func (reservation Reservation) NamespacedID() string {
+	return reservationID(reservation.AdminProject, reservation.Location, reservation.Name)
+}
+
+// Name and location of the reservation for display, e.g. 'r1 (admin:US)', or
+// 'r1 (US)' for states archived without admin project
+func (reservation Reservation) Title() string {
+	location := reservation.Location
+	if reservation.AdminProject != "" {
+		location = fmt.Sprintf("%s:%s", reservation.AdminProject, location)
+	}
+	return fmt.Sprintf("%s (%s)", reservation.Name, location)
+}
+
+// Join a location and name, prefixed with the admin project unless empty
+func reservationID(project string, location string, name string) string {
+	if project == "" {
+		return fmt.Sprintf("%s.%s", location, name)
+	}
+	return fmt.Sprintf("%s:%s.%s", project, location, name)
+}
+
+// Split a reservation ID into admin project, location and name. The admin project
+// is empty unless the ID is namespaced.
+func ParseReservationID(id string) (string, string, string, error) {
+	// Domain-scoped projects contain colons as well, e.g. 'example.com:admin'
+	project, qualified := "", id
+	if i := strings.LastIndex(id, ":"); i >= 0 {
+		project, qualified = id[:i], id[i+1:]
+	}
+	tokens := strings.SplitN(qualified, ".", 2)
+	if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+		return "", "", "", fmt.Errorf("invalid reservation ID: %s", id)
+	}
+	return project, tokens[0], tokens[1], nil
+}
+
+// Retrieves the slots of active capacity commitments in all admin projects, keyed
+// by admin project, location and edition like namespaced reservations, e.g.
+// 'admin:US.ENTERPRISE'
+func RetrieveCommitments(ctx context.Context, projects []string, locations []string) (map[string]float64, error) {
+	client, err := reservationSDK.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	// Create sync & comms for concurrent invokations, with room for an error from
+	// every routine so none blocks once reading stops
+	ch := make(chan commitment)
+	errs := make(chan error, len(projects)*len(locations))
+	var wg sync.WaitGroup
+	wg.Add(len(projects) * len(locations))
+
+	for _, project := range projects {
+		for _, location := range locations {
+			// Create a per-region routine to avoid blocking on I/O during API calls
+			go retrieveCommitmentLocation(ctx, client, project, location, ch, errs, &wg)
+		}
+	}
+
+	go func() {
+		// Synchronize routines and close channels
+		wg.Wait()
+		close(ch)
+		close(errs)
+	}()
+
+	// Sum active commitment slots per admin project, location and edition
+	commitments := make(map[string]float64)
+	for found := range ch {
+		commitments[found.id] += found.slots
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return commitments, nil
+}
+
+// Slots of an active capacity commitment, with the ID of its admin project,
+// location and edition
+type commitment struct {
+	id    string
+	slots float64
+}
+
+// Routine to retrieve active capacity commitments for a given region/location
+func retrieveCommitmentLocation(ctx context.Context, client *reservationSDK.Client, project string, location string, ch chan<- commitment, errs chan<- error, wg *sync.WaitGroup) {
+	// Defer completion signal on wait group
+	defer wg.Done()
+
+	request := &reservationPB.ListCapacityCommitmentsRequest{
+		Parent: fmt.Sprintf("projects/%s/locations/%s", project, location),
+	}
+	it := client.ListCapacityCommitments(ctx, request)
+	for {
+		response, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			errs <- err
+			return
+		}
+		if response.State != reservationPB.CapacityCommitment_ACTIVE {
+			continue
+		}
+		ch <- commitment{
+			id:    reservationID(project, location, response.Edition.String()),
+			slots: float64(response.SlotCount),
 		}
 	}
 }
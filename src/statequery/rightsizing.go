@@ -0,0 +1,297 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Granularity of recommended slots, as reservations and autoscaling are sized
+// in multiples of 50 slots
+const slotIncrement = 50
+
+// Minimum number of samples to recommend the size of a reservation on
+const minSizingSamples = 12
+
+// Fraction of the current capacity recommendations may differ by before a
+// reservation is flagged, in addition to at least one increment
+const sizingTolerance = 0.1
+
+// Capacity recommendations for all reservations over a window of history
+type Rightsizing struct {
+	From         time.Time                    `json:"from"`
+	To           time.Time                    `json:"to"`
+	Threshold    float64                      `json:"threshold"`
+	Reservations map[string]ReservationSizing `json:"reservations"`
+	Commitments  []CommitmentSizing           `json:"commitments"`
+}
+
+// Utilization percentiles and recommended capacity of a reservation. Utilizations
+// are fractions of the baseline slots at the time of each sample, usage is in slots.
+type ReservationSizing struct {
+	Name              string  `json:"name"`
+	Location          string  `json:"location"`
+	AdminProject      string  `json:"admin_project,omitempty"`
+	Edition           string  `json:"edition,omitempty"`
+	Samples           int     `json:"samples"`
+	Slots             float64 `json:"slots"`
+	AutoscaleMaxSlots float64 `json:"autoscale_max_slots"`
+	P50               float64 `json:"p50"`
+	P95               float64 `json:"p95"`
+	P99               float64 `json:"p99"`
+	UsageP50          float64 `json:"usage_p50"`
+	UsageP95          float64 `json:"usage_p95"`
+	UsageP99          float64 `json:"usage_p99"`
+
+	// Baseline covering the median usage, and autoscaling up to the capacity
+	// keeping the 99th percentile of usage below the threshold
+	RecommendedSlots             float64 `json:"recommended_slots"`
+	RecommendedAutoscaleMaxSlots float64 `json:"recommended_autoscale_max_slots"`
+	// Estimated change of the hourly cost of the baseline, if prices are known.
+	// Autoscaled slots are billed by use, so the autoscale maximum is not priced.
+	BaselineHourlyCostChange float64 `json:"baseline_hourly_cost_change,omitempty"`
+	// Whether the recommended total capacity differs from the current one by more
+	// than one increment and sizingTolerance
+	Oversized  bool `json:"oversized"`
+	Undersized bool `json:"undersized"`
+}
+
+// Name and location of the reservation for display, see Reservation.Title
+func (sizing ReservationSizing) Title() string {
+	return Reservation{Name: sizing.Name, Location: sizing.Location, AdminProject: sizing.AdminProject}.Title()
+}
+
+// Active and recommended commitments of an edition in a location. Commitments
+// should cover the baselines of all reservations, as autoscaled slots are billed
+// on demand.
+type CommitmentSizing struct {
+	AdminProject     string  `json:"admin_project,omitempty"`
+	Location         string  `json:"location"`
+	Edition          string  `json:"edition"`
+	Committed        float64 `json:"committed"`
+	RecommendedSlots float64 `json:"recommended_slots"`
+}
+
+// Usage of a reservation in a single archived state
+type sizingSample struct {
+	timestamp   time.Time
+	reservation Reservation
+	utilization float64
+	usage       float64
+}
+
+// Analyze the states archived in the bucket between from and to, recommending the
+// capacity of each reservation and the commitments per location and edition.
+// Reservations missing from the latest archived states, e.g. deleted ones, are
+// skipped. Commitments are keyed by location and edition, see RetrieveCommitments.
+func AnalyzeRightsizing(ctx context.Context, bucket string, from time.Time, to time.Time, threshold float64, commitments map[string]float64, prices PriceTable) (*Rightsizing, error) {
+	samples := make(map[string][]sizingSample)
+	latest := time.Time{}
+	err := WalkHistory(ctx, bucket, from, func(state *State) {
+		if state.Timestamp.After(to) {
+			return
+		}
+		if state.Timestamp.After(latest) {
+			latest = state.Timestamp
+		}
+		for id, reservation := range state.Reservations {
+			samples[id] = append(samples[id], sizingSample{
+				timestamp: state.Timestamp,
+				reservation: Reservation{
+					Name:              reservation.Name,
+					Location:          reservation.Location,
+					AdminProject:      reservation.AdminProject,
+					Slots:             reservation.Slots,
+					Edition:           reservation.Edition,
+					AutoscaleMaxSlots: reservation.AutoscaleMaxSlots,
+				},
+				utilization: reservation.UtilizationFactor(),
+				usage:       reservation.TotalUsage,
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rightsizing := &Rightsizing{
+		From:         from,
+		To:           to,
+		Threshold:    threshold,
+		Reservations: make(map[string]ReservationSizing),
+	}
+	for id, series := range samples {
+		if len(series) < minSizingSamples {
+			continue
+		}
+		sizing, last := size(series, threshold, prices)
+		if latest.Sub(last) > maxSampleGap {
+			continue
+		}
+		rightsizing.Reservations[id] = sizing
+	}
+	rightsizing.Commitments = sizeCommitments(rightsizing.Reservations, commitments)
+	return rightsizing, nil
+}
+
+// Compute the percentiles and recommendations of a reservation from its samples,
+// returning the time of the latest sample
+func size(series []sizingSample, threshold float64, prices PriceTable) (ReservationSizing, time.Time) {
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].timestamp.Before(series[j].timestamp)
+	})
+
+	// Capacity, names and edition as of the end of the window
+	last := series[len(series)-1]
+	sizing := ReservationSizing{
+		Name:              last.reservation.Name,
+		Location:          last.reservation.Location,
+		AdminProject:      last.reservation.AdminProject,
+		Edition:           last.reservation.Edition,
+		Samples:           len(series),
+		Slots:             last.reservation.Slots,
+		AutoscaleMaxSlots: last.reservation.AutoscaleMaxSlots,
+	}
+
+	utilizations := make([]float64, 0, len(series))
+	usages := make([]float64, 0, len(series))
+	for _, sample := range series {
+		utilizations = append(utilizations, sample.utilization)
+		usages = append(usages, sample.usage)
+	}
+	sizing.P50 = percentile(utilizations, 0.5)
+	sizing.P95 = percentile(utilizations, 0.95)
+	sizing.P99 = percentile(utilizations, 0.99)
+	sizing.UsageP50 = percentile(usages, 0.5)
+	sizing.UsageP95 = percentile(usages, 0.95)
+	sizing.UsageP99 = percentile(usages, 0.99)
+
+	capacity := sizing.UsageP99
+	if threshold > 0 {
+		capacity /= threshold
+	}
+	sizing.RecommendedSlots = roundSlots(sizing.UsageP50)
+	sizing.RecommendedAutoscaleMaxSlots = math.Max(0, roundSlots(capacity)-sizing.RecommendedSlots)
+
+	// Compare the total capacity, as autoscaling may make up for a small baseline,
+	// ignoring differences within the tolerance, which are noise of the percentiles
+	current := sizing.Slots + sizing.AutoscaleMaxSlots
+	recommended := sizing.RecommendedSlots + sizing.RecommendedAutoscaleMaxSlots
+	tolerance := math.Max(slotIncrement, current*sizingTolerance)
+	sizing.Oversized = current-recommended > tolerance
+	sizing.Undersized = recommended-current > tolerance
+
+	if price, ok := prices.Price(sizing.Edition, sizing.Location); ok && sizing.Edition != "" {
+		sizing.BaselineHourlyCostChange = (sizing.RecommendedSlots - sizing.Slots) * price
+	}
+	return sizing, last.timestamp
+}
+
+// Sum up the recommended baselines per admin project, location and edition, next
+// to the active commitments
+func sizeCommitments(reservations map[string]ReservationSizing, commitments map[string]float64) []CommitmentSizing {
+	sizings := make(map[string]*CommitmentSizing)
+	for _, reservation := range reservations {
+		// Legacy flat-rate reservations cannot be covered by edition commitments
+		if reservation.Edition == "" {
+			continue
+		}
+		key := reservationID(reservation.AdminProject, reservation.Location, reservation.Edition)
+		if sizings[key] == nil {
+			sizings[key] = &CommitmentSizing{
+				AdminProject: reservation.AdminProject,
+				Location:     reservation.Location,
+				Edition:      reservation.Edition,
+				Committed:    commitments[key],
+			}
+		}
+		sizings[key].RecommendedSlots += reservation.RecommendedSlots
+	}
+
+	result := make([]CommitmentSizing, 0, len(sizings))
+	for _, sizing := range sizings {
+		result = append(result, *sizing)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].AdminProject != result[j].AdminProject {
+			return result[i].AdminProject < result[j].AdminProject
+		}
+		if result[i].Location != result[j].Location {
+			return result[i].Location < result[j].Location
+		}
+		return result[i].Edition < result[j].Edition
+	})
+	return result
+}
+
+// Round slots up to the next increment
+func roundSlots(slots float64) float64 {
+	return math.Ceil(slots/slotIncrement) * slotIncrement
+}
+
+// Render the recommendations with the templates of a notifier
+func (rightsizing *Rightsizing) render(templates *Templates) (string, error) {
+	return templates.Rightsizing(rightsizing)
+}
+
+// Subject line of right-sizing emails
+func (rightsizing *Rightsizing) subject() string {
+	return fmt.Sprintf("BigQuery reservation right-sizing: %s to %s",
+		rightsizing.From.Format("2006-01-02"), rightsizing.To.Format("2006-01-02"))
+}
+
+// State holding the reservations of the recommendations, to report deliveries on them
+func (rightsizing *Rightsizing) state() *State {
+	state := &State{Timestamp: rightsizing.To, Reservations: make(map[string]Reservation)}
+	for id, reservation := range rightsizing.Reservations {
+		state.Reservations[id] = Reservation{Name: reservation.Name, Location: reservation.Location, AdminProject: reservation.AdminProject, Slots: reservation.Slots}
+	}
+	return state
+}
+
+// Recommendations exercising all parts of right-sizing templates
+func sampleRightsizing() *Rightsizing {
+	now := time.Now().UTC()
+	return &Rightsizing{
+		From:      now.Add(-28 * 24 * time.Hour),
+		To:        now,
+		Threshold: 0.8,
+		Reservations: map[string]ReservationSizing{
+			"US.sample": {
+				Name:                         "sample",
+				Location:                     "US",
+				Edition:                      "ENTERPRISE",
+				Samples:                      8064,
+				Slots:                        1000,
+				AutoscaleMaxSlots:            500,
+				P50:                          0.3,
+				P95:                          0.6,
+				P99:                          0.7,
+				UsageP50:                     300,
+				UsageP95:                     600,
+				UsageP99:                     700,
+				RecommendedSlots:             300,
+				RecommendedAutoscaleMaxSlots: 600,
+				BaselineHourlyCostChange:     -42,
+				Oversized:                    true,
+			},
+		},
+		Commitments: []CommitmentSizing{{Location: "US", Edition: "ENTERPRISE", Committed: 1000, RecommendedSlots: 300}},
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSizeTolerance(t *testing.T) {
+	tests := []struct {
+		name       string
+		slots      float64
+		autoscale  float64
+		usage      float64
+		oversized  bool
+		undersized bool
+		// Change of the baseline cost at $0.06 per slot-hour
+		costChange float64
+	}{
+		// Recommended 250 + 50 autoscale against 400
+		{"oversized", 300, 100, 240, true, false, -3},
+		// Recommended 250 + 50 autoscale against 350, a single increment
+		{"single increment", 300, 50, 240, false, false, -3},
+		// Recommended 1700 + 450 autoscale against 2000, within 10%
+		{"within tolerance", 2000, 0, 1700, false, false, -18},
+		// Recommended 1900 + 500 autoscale against 2000
+		{"undersized", 2000, 0, 1900, false, true, -6},
+		{"matching", 250, 50, 240, false, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+			var series []sizingSample
+			for i := 0; i < minSizingSamples; i++ {
+				series = append(series, sizingSample{
+					timestamp: start.Add(time.Duration(i) * time.Minute),
+					reservation: Reservation{
+						Name:              "r1",
+						Location:          "US",
+						Edition:           "ENTERPRISE",
+						Slots:             test.slots,
+						AutoscaleMaxSlots: test.autoscale,
+					},
+					usage: test.usage,
+				})
+			}
+
+			sizing, _ := size(series, 0.8, DefaultPrices)
+			if sizing.Oversized != test.oversized || sizing.Undersized != test.undersized {
+				t.Errorf("expected oversized %v and undersized %v, got %+v", test.oversized, test.undersized, sizing)
+			}
+			if math.Abs(sizing.BaselineHourlyCostChange-test.costChange) > 1e-9 {
+				t.Errorf("expected baseline cost change %v, got %v", test.costChange, sizing.BaselineHourlyCostChange)
+			}
+		})
+	}
+}
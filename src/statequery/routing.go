@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"path"
+	"strings"
+)
+
+// Alert severities
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+)
+
+// Matches reservations by their properties. Empty fields match everything, all
+// given fields need to match.
+type Matcher struct {
+	// Glob on the reservation ID (e.g. 'US.*') or name
+	Reservation string `json:"reservation,omitempty"`
+	Location    string `json:"location,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+	// Glob on the admin project of the reservation
+	AdminProject string `json:"admin_project,omitempty"`
+	// Glob on any project consuming the reservation
+	Project string `json:"project,omitempty"`
+	// Label of any running job, as 'key=value' or 'key'
+	Label string `json:"label,omitempty"`
+}
+
+// Route mapping matching reservations to named notifiers. Routes are evaluated in
+// order and evaluation stops at the first match, unless Continue is set.
+type Route struct {
+	Name      string   `json:"name"`
+	Match     Matcher  `json:"match"`
+	Notifiers []string `json:"notifiers"`
+	Continue  bool     `json:"continue"`
+}
+
+// Set of routes, with default notifiers for reservations not matching any route
+type Router struct {
+	Routes  []Route  `json:"routes"`
+	Default []string `json:"default"`
+}
+
+// Result of routing a single reservation
+type RouteMatch struct {
+	Severity  string   `json:"severity"`
+	Alerting  bool     `json:"alerting"`
+	Routes    []string `json:"routes"`
+	Notifiers []string `json:"notifiers"`
+}
+
+// Severity of the alert on a reservation, empty if there is nothing to alert on.
+// Suppressed reservations keep their severity, so silences can match on it.
+func (reservation Reservation) Severity() string {
+	if reservation.ThresholdBreached {
+		return SeverityCritical
+	}
+	if len(reservation.RunawayJobs) > 0 || (reservation.Forecast != nil && reservation.Forecast.EarlyWarning) {
+		return SeverityWarning
+	}
+	return ""
+}
+
+// Whether a reservation matches all given criteria
+func (matcher Matcher) Matches(id string, reservation Reservation) bool {
+	if matcher.Reservation != "" && !glob(matcher.Reservation, id) && !glob(matcher.Reservation, reservation.Name) {
+		return false
+	}
+	if matcher.Location != "" && !strings.EqualFold(matcher.Location, reservation.Location) {
+		return false
+	}
+	if matcher.Severity != "" && matcher.Severity != reservation.Severity() {
+		return false
+	}
+	if matcher.AdminProject != "" && !glob(matcher.AdminProject, reservation.AdminProject) {
+		return false
+	}
+	if matcher.Project != "" && !matchesAnyProject(matcher.Project, reservation) {
+		return false
+	}
+	if matcher.Label != "" && !matchesAnyLabel(matcher.Label, reservation) {
+		return false
+	}
+	return true
+}
+
+// Whether any project consuming the reservation matches the glob
+func matchesAnyProject(pattern string, reservation Reservation) bool {
+	for _, project := range reservation.Projects {
+		if glob(pattern, project) {
+			return true
+		}
+	}
+	for _, job := range reservation.Jobs {
+		if glob(pattern, job.Project) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether any running job of the reservation carries the label
+func matchesAnyLabel(label string, reservation Reservation) bool {
+	tokens := strings.SplitN(label, "=", 2)
+	for _, job := range reservation.Jobs {
+		value, ok := job.Labels[tokens[0]]
+		if ok && (len(tokens) == 1 || value == tokens[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match a glob pattern, treating malformed patterns as literals
+func glob(pattern string, value string) bool {
+	matched, err := path.Match(pattern, value)
+	if err != nil {
+		return pattern == value
+	}
+	return matched
+}
+
+// Determine the routes and notifiers a reservation is routed to
+func (router *Router) Match(id string, reservation Reservation) RouteMatch {
+	match := RouteMatch{
+		Severity: reservation.Severity(),
+		Alerting: reservation.Alerting(),
+	}
+
+	for _, route := range router.Routes {
+		if !route.Match.Matches(id, reservation) {
+			continue
+		}
+		match.Routes = append(match.Routes, route.Name)
+		match.Notifiers = append(match.Notifiers, route.Notifiers...)
+		if !route.Continue {
+			break
+		}
+	}
+
+	// Fall back to the default route if no route matched
+	if len(match.Routes) == 0 {
+		match.Routes = []string{"default"}
+		match.Notifiers = append(match.Notifiers, router.Default...)
+	}
+	match.Notifiers = trimDuplicates(match.Notifiers)
+	return match
+}
+
+// Split the alerting reservations of a state into one state per notifier, holding
+// only the reservations routed to it. Acknowledged alerts are left out.
+func (router *Router) Dispatch(state *State) map[string]*State {
+	dispatched := make(map[string]*State)
+	for id, reservation := range state.Reservations {
+		if !reservation.Alerting() || reservation.AcknowledgedBy != "" {
+			continue
+		}
+
+		for _, notifier := range router.Match(id, reservation).Notifiers {
+			routed, ok := dispatched[notifier]
+			if !ok {
+				routed = state.subset()
+				dispatched[notifier] = routed
+			}
+			routed.Reservations[id] = reservation
+		}
+	}
+	return dispatched
+}
+
+// Copy of the state without any reservations
+func (state *State) subset() *State {
+	return &State{
+		Timestamp:    state.Timestamp,
+		Reservations: make(map[string]Reservation),
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	storageSDK "cloud.google.com/go/storage"
+)
+
+// Object in the state bucket holding all silences
+const silencesObject = "silences.json"
+
+// Returned when a silence does not exist
+var ErrSilenceNotFound = errors.New("silence not found")
+
+// Silence suppressing alerts for matching reservations within a period of time
+type Silence struct {
+	ID        string    `json:"id"`
+	Match     Matcher   `json:"match"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Comment   string    `json:"comment"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Stored form of all silences
+type silenceDocument struct {
+	Silences []Silence `json:"silences"`
+}
+
+// Whether the silence is in effect at the given time
+func (silence Silence) Active(t time.Time) bool {
+	return !t.Before(silence.StartsAt) && t.Before(silence.EndsAt)
+}
+
+// Silences persisted in the state bucket. Updates are conditional on the object
+// generation, so concurrent instances do not lose each other's silences.
+type SilenceStore struct {
+	client *storageSDK.Client
+	bucket string
+}
+
+// Create a silence store in the given bucket
+func NewSilenceStore(ctx context.Context, bucket string) (*SilenceStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket for silences not configured")
+	}
+	client, err := storageSDK.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &SilenceStore{client: client, bucket: bucket}, nil
+}
+
+// List all silences, which have not expired yet
+func (store *SilenceStore) List(ctx context.Context) ([]Silence, error) {
+	document := silenceDocument{}
+	_, err := readObject(ctx, store.client, store.bucket, silencesObject, &document)
+	if err != nil {
+		return nil, err
+	}
+	return unexpired(document.Silences, time.Now().UTC()), nil
+}
+
+// Add a silence, assigning it a new ID
+func (store *SilenceStore) Add(ctx context.Context, silence Silence) (Silence, error) {
+	if !silence.EndsAt.After(silence.StartsAt) {
+		return Silence{}, fmt.Errorf("silence must end after it starts")
+	}
+
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return Silence{}, err
+	}
+	silence.ID = hex.EncodeToString(id)
+	silence.CreatedAt = time.Now().UTC()
+
+	err = store.update(ctx, func(silences []Silence) ([]Silence, error) {
+		return append(silences, silence), nil
+	})
+	return silence, err
+}
+
+// Delete a silence by ID
+func (store *SilenceStore) Delete(ctx context.Context, id string) error {
+	return store.update(ctx, func(silences []Silence) ([]Silence, error) {
+		for i, silence := range silences {
+			if silence.ID == id {
+				return append(silences[:i], silences[i+1:]...), nil
+			}
+		}
+		return nil, ErrSilenceNotFound
+	})
+}
+
+// Apply a modification to the stored silences, dropping expired ones and retrying
+// on concurrent modifications
+func (store *SilenceStore) update(ctx context.Context, modify func([]Silence) ([]Silence, error)) error {
+	for attempt := 0; attempt < 5; attempt++ {
+		document := silenceDocument{}
+		generation, err := readObject(ctx, store.client, store.bucket, silencesObject, &document)
+		if err != nil {
+			return err
+		}
+
+		silences, err := modify(unexpired(document.Silences, time.Now().UTC()))
+		if err != nil {
+			return err
+		}
+
+		_, err = writeObject(ctx, store.client, store.bucket, silencesObject, silenceDocument{Silences: silences}, generation)
+		if err == ErrVersionConflict {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("giving up updating silences after repeated conflicts")
+}
+
+// Filter out silences, which ended before the given time
+func unexpired(silences []Silence, t time.Time) []Silence {
+	result := []Silence{}
+	for _, silence := range silences {
+		if t.Before(silence.EndsAt) {
+			result = append(result, silence)
+		}
+	}
+	return result
+}
+
+// Recurring maintenance window, starting whenever the cron schedule (UTC) matches
+// and lasting for the given duration
+type MaintenanceWindow struct {
+	Name     string   `json:"name"`
+	Match    Matcher  `json:"match"`
+	Schedule string   `json:"schedule"`
+	Duration Duration `json:"duration"`
+	cron     *cronSchedule
+}
+
+// Parse the schedule of the maintenance window
+func (window *MaintenanceWindow) Compile() error {
+	cron, err := parseCron(window.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule of maintenance window %s: %v", window.Name, err)
+	}
+	if window.Duration.Duration <= 0 {
+		return fmt.Errorf("invalid duration of maintenance window %s", window.Name)
+	}
+	window.cron = cron
+	return nil
+}
+
+// Whether the maintenance window is in effect at the given time, i.e. whether the
+// schedule matched within the duration before it
+func (window *MaintenanceWindow) Active(t time.Time) bool {
+	if window.cron == nil {
+		return false
+	}
+	minute := t.UTC().Truncate(time.Minute)
+	for start := minute; t.Sub(start) < window.Duration.Duration; start = start.Add(-time.Minute) {
+		if window.cron.matches(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mark reservations matched by an active silence or maintenance window as suppressed.
+// Their breaches are kept in the state, but no alerts are sent for them.
+func (state *State) ApplySuppressions(silences []Silence, windows []MaintenanceWindow) {
+	now := state.Timestamp
+	if now.IsZero() {
+		now = time.Now().UTC()
+	}
+
+	for id, reservation := range state.Reservations {
+		reservation.Suppressed = false
+		reservation.SuppressedBy = ""
+
+		for _, silence := range silences {
+			if silence.Active(now) && silence.Match.Matches(id, reservation) {
+				reservation.Suppressed = true
+				reservation.SuppressedBy = fmt.Sprintf("silence:%s", silence.ID)
+				break
+			}
+		}
+		for i := range windows {
+			if reservation.Suppressed {
+				break
+			}
+			if windows[i].Active(now) && windows[i].Match.Matches(id, reservation) {
+				reservation.Suppressed = true
+				reservation.SuppressedBy = fmt.Sprintf("maintenance:%s", windows[i].Name)
+			}
+		}
+		state.Reservations[id] = reservation
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Base URL of the Slack Web API
+const slackAPI = "https://slack.com/api/"
+
+// Client for the Slack Web API, authenticated with a bot token
+type SlackClient struct {
+	token  func() string
+	policy DeliveryPolicy
+}
+
+// Create a Slack client. The token is resolved on every call, so rotated secrets
+// are picked up without a restart.
+func NewSlackClient(token func() string, policy DeliveryPolicy) *SlackClient {
+	return &SlackClient{token: token, policy: policy}
+}
+
+// Type for the common fields of Slack Web API responses
+type slackResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// Post a message to a channel, optionally as reply in a thread. Returns the
+// channel ID and timestamp of the message.
+func (client *SlackClient) PostMessage(ctx context.Context, channel string, text string, thread string) (string, string, error) {
+	payload := map[string]string{"channel": channel, "text": text}
+	if thread != "" {
+		payload["thread_ts"] = thread
+	}
+	response, _, err := client.call(ctx, "chat.postMessage", payload, client.policy)
+	if err != nil {
+		return "", "", err
+	}
+	return response.Channel, response.TS, nil
+}
+
+// Call a Web API method, retrying on rate limits and server errors according to
+// the policy. Slack reports most errors with status 200 and 'ok' unset, which are
+// not retried.
+func (client *SlackClient) call(ctx context.Context, method string, payload interface{}, policy DeliveryPolicy) (*slackResponse, int, error) {
+	token := client.token()
+	if token == "" {
+		return nil, 0, fmt.Errorf("slack bot token not configured")
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response := &slackResponse{}
+	attempts, err := withRetries(ctx, policy, func(ctx context.Context) (time.Duration, *DeliveryError) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, slackAPI+method, bytes.NewReader(data))
+		if err != nil {
+			return -1, &DeliveryError{Err: err}
+		}
+		request.Header.Set("Content-Type", "application/json; charset=utf-8")
+		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		result, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return requestRetry(err)
+		}
+		defer result.Body.Close()
+
+		if result.StatusCode == http.StatusTooManyRequests || result.StatusCode >= 500 {
+			io.Copy(ioutil.Discard, result.Body)
+			return retryAfter(result.Header.Get("Retry-After")), &DeliveryError{
+				StatusCode: result.StatusCode,
+				Err:        fmt.Errorf("unexpected response %s from %s", result.Status, method),
+			}
+		}
+
+		err = json.NewDecoder(result.Body).Decode(response)
+		if err != nil {
+			return -1, &DeliveryError{StatusCode: result.StatusCode, Err: err}
+		}
+		if !response.OK {
+			return -1, &DeliveryError{StatusCode: result.StatusCode, Err: fmt.Errorf("%s failed: %s", method, response.Error)}
+		}
+		return 0, nil
+	})
+	if err != nil {
+		return nil, attempts, err
+	}
+	return response, attempts, nil
+}
+
+// Reply to a slash command through its response URL, either visible to the whole
+// channel or only to the invoking user
+func RespondSlack(ctx context.Context, responseURL string, text string, public bool) error {
+	responseType := "ephemeral"
+	if public {
+		responseType = "in_channel"
+	}
+	return PostJSON(ctx, responseURL, map[string]string{
+		"response_type": responseType,
+		"text":          text,
+	})
+}
+
+// Notifier posting to a Slack channel with the bot token. Every alerting
+// reservation is posted separately: the first message of an incident starts a
+// thread, further updates are replied to it and the first message is updated once
+// the incident resolves.
+type SlackNotifier struct {
+	name      string
+	channel   string
+	client    *SlackClient
+	templates *Templates
+	policy    DeliveryPolicy
+
+	// Action buttons added to the messages, if set
+	Actions *AlertActions
+}
+
+// Create a Slack notifier posting to the given channel (name or ID) through the client
+func NewSlackNotifier(name string, channel string, client *SlackClient, templates *Templates, policy DeliveryPolicy) (*SlackNotifier, error) {
+	if channel == "" {
+		return nil, fmt.Errorf("channel of notifier %s not configured", name)
+	}
+	return &SlackNotifier{name: name, channel: channel, client: client, templates: templates, policy: policy}, nil
+}
+
+// Name of the notifier instance
+func (notifier *SlackNotifier) Name() string {
+	return notifier.name
+}
+
+// Render the state per reservation and post it to the thread of its incident,
+// starting one if needed
+func (notifier *SlackNotifier) Notify(ctx context.Context, state *State) Delivery {
+	log.Printf("publishing message to %s\n", notifier.name)
+
+	return notifyThreads(ctx, notifier.name, notifier.templates, state, func(ctx context.Context, id string, single *State, message string, thread Thread, threaded bool) (Thread, int, error) {
+		payload := map[string]interface{}{"channel": notifier.channel, "text": message}
+		if notifier.Actions != nil {
+			payload["blocks"] = notifier.Actions.SlackBlocks(single, message)
+		}
+		if threaded {
+			payload["channel"] = thread.Channel
+			payload["thread_ts"] = thread.Thread
+		}
+
+		response, tries, err := notifier.client.call(ctx, "chat.postMessage", payload, notifier.policy)
+		if err != nil {
+			return Thread{}, tries, err
+		}
+		return Thread{Channel: response.Channel, Thread: response.TS, Message: response.TS}, tries, nil
+	})
+}
+
+// Resolve incidents, see resolveThreads
+func (notifier *SlackNotifier) Resolve(ctx context.Context, transitions []Transition) Delivery {
+	update := func(ctx context.Context, thread Thread, text string) (int, error) {
+		// Replace the alert including its buttons, which are no longer of use
+		_, tries, err := notifier.client.call(ctx, "chat.update", map[string]interface{}{
+			"channel": thread.Channel,
+			"ts":      thread.Message,
+			"text":    text,
+			"blocks": []interface{}{
+				map[string]interface{}{
+					"type": "section",
+					"text": map[string]string{"type": "mrkdwn", "text": fmt.Sprintf(":white_check_mark: %s", text)},
+				},
+			},
+		}, notifier.policy)
+		return tries, err
+	}
+	reply := func(ctx context.Context, thread Thread, text string) (int, error) {
+		_, tries, err := notifier.client.call(ctx, "chat.postMessage", map[string]interface{}{
+			"channel":   thread.Channel,
+			"thread_ts": thread.Thread,
+			"text":      text,
+		}, notifier.policy)
+		return tries, err
+	}
+	return resolveThreads(ctx, notifier.name, notifier.templates, transitions, update, reply)
+}
+
+// Render the report and post it to the channel, outside of any thread
+func (notifier *SlackNotifier) NotifyReport(ctx context.Context, report Report) Delivery {
+	log.Printf("publishing report to %s\n", notifier.name)
+
+	state := report.state()
+	message, err := report.render(notifier.templates)
+	if err != nil {
+		return NewDelivery(notifier.name, state, 0, err)
+	}
+	_, attempts, err := notifier.client.call(ctx, "chat.postMessage", map[string]interface{}{
+		"channel": notifier.channel,
+		"text":    message,
+	}, notifier.policy)
+	return NewDelivery(notifier.name, state, attempts, err)
+}
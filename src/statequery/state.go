@@ -14,27 +14,59 @@
 
 package statequery
 
+import "time"
+
 // Type to hold all state per execution
 type State struct {
+	Timestamp    time.Time              `json:"timestamp"`
 	Reservations map[string]Reservation `json:"reservations"`
+	Cache        *CacheStats            `json:"cache,omitempty"`
+	Deliveries   []Delivery             `json:"deliveries,omitempty"`
+	Transitions  []Transition           `json:"transitions,omitempty"`
 }
 
 // Type for individual reservation data
 type Reservation struct {
 	Name              string   `json:"name"`
 	Location          string   `json:"location"`
+	AdminProject      string   `json:"admin_project,omitempty"`
 	Slots             float64  `json:"slots"`
+	Edition           string   `json:"edition,omitempty"`
+	AutoscaleMaxSlots float64  `json:"autoscale_max_slots,omitempty"`
+	HourlyCost        float64  `json:"hourly_cost,omitempty"`
 	Projects          []string `json:"projects"`
 	Jobs              []Job    `json:"jobs"`
 	NumJobs           int      `json:"num_jobs"`
 	TotalUsage        float64  `json:"total_usage"`
 	TotalUsageCeiling int      `json:"total_usage_ceiling"`
+	Utilization       float64  `json:"utilization"`
 	ThresholdBreached bool     `json:"threshold_breached"`
 	Percentage        string   `json:"percentage"`
+	// Slots needed to bring the current usage of breached reservations below the
+	// threshold, and their estimated cost
+	AdditionalSlots      int          `json:"additional_slots,omitempty"`
+	AdditionalHourlyCost float64      `json:"additional_hourly_cost,omitempty"`
+	Forecast             *Forecast    `json:"forecast,omitempty"`
+	Anomaly              *Anomaly     `json:"anomaly,omitempty"`
+	RunawayJobs          []RunawayJob `json:"runaway_jobs,omitempty"`
+	Suppressed           bool         `json:"suppressed,omitempty"`
+	SuppressedBy         string       `json:"suppressed_by,omitempty"`
+	AcknowledgedBy       string       `json:"acknowledged_by,omitempty"`
+	AlertingSince        *time.Time   `json:"alerting_since,omitempty"`
+
+	// Threads of the incident per notifier, tracked in the incident store
+	Threads map[string]Thread `json:"-"`
 }
 
 // Type for job data
 type Job struct {
-	Name  string  `json:"name"`
-	Usage float64 `json:"usage"`
+	Name           string            `json:"name"`
+	ID             string            `json:"id"`
+	Project        string            `json:"project"`
+	Location       string            `json:"location"`
+	User           string            `json:"user"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Usage          float64           `json:"usage"`
+	RuntimeMillis  int64             `json:"runtime_ms"`
+	BytesProcessed int64             `json:"bytes_processed"`
 }
@@ -17,32 +17,140 @@ package statequery
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"time"
 
 	storageSDK "cloud.google.com/go/storage"
+	googleapi "google.golang.org/api/googleapi"
+	iterator "google.golang.org/api/iterator"
 )
 
+// Returned when a versioned object has been modified by another writer
+var ErrVersionConflict = errors.New("object was modified concurrently")
+
 // Archive the current state into timestamped GCS object
 func (state *State) DumpState(ctx context.Context, bucket string) error {
 	// Abort if no bucket has been specified
+	if bucket == "" {
+		log.Println("bucket for state dumps not configured, skipping...")
+		return nil
+	}
+
 	client, err := storageSDK.NewClient(ctx)
 	if err != nil {
-		log.Println("bucket for state dumps not configured, skipping...")
 		return err
 	}
+	defer client.Close()
 
 	// Create object key with timestamp
-	stamp := fmt.Sprintf("%v", time.Now().UTC().Unix())
+	timestamp := state.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now().UTC()
+	}
+	stamp := fmt.Sprintf("%v", timestamp.Unix())
 	object := fmt.Sprintf("state-%s.json", stamp)
 
 	// Create GCS writer for new object
 	writer := client.Bucket(bucket).Object(object).NewWriter(ctx)
-	defer writer.Close()
 	writer.ContentType = "application/json"
 
 	// Encode state to the bucket writer
-	json.NewEncoder(writer).Encode(state)
-	return nil
+	err = json.NewEncoder(writer).Encode(state)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// Load the most recently archived state from the bucket
+func LoadLatestState(ctx context.Context, bucket string) (*State, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket for state dumps not configured")
+	}
+
+	client, err := storageSDK.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	// Find the latest dump. Object names embed unix timestamps of equal length,
+	// so lexicographical order matches chronological order.
+	latest := ""
+	it := client.Bucket(bucket).Objects(ctx, &storageSDK.Query{Prefix: "state-"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Name > latest {
+			latest = attrs.Name
+		}
+	}
+	if latest == "" {
+		return nil, fmt.Errorf("no state dumps found in bucket: %s", bucket)
+	}
+
+	state := &State{}
+	_, err = readObject(ctx, client, bucket, latest, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Read and decode a JSON object, returning its generation. A generation of zero
+// and no error are returned if the object does not exist.
+func readObject(ctx context.Context, client *storageSDK.Client, bucket string, object string, v interface{}) (int64, error) {
+	reader, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	if err == storageSDK.ErrObjectNotExist {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	err = json.NewDecoder(reader).Decode(v)
+	if err != nil {
+		return 0, err
+	}
+	return reader.Attrs.Generation, nil
+}
+
+// Encode and write a JSON object if its generation still matches, returning the
+// new generation. A generation of zero requires the object to not exist yet.
+func writeObject(ctx context.Context, client *storageSDK.Client, bucket string, object string, v interface{}, generation int64) (int64, error) {
+	handle := client.Bucket(bucket).Object(object)
+	if generation == 0 {
+		handle = handle.If(storageSDK.Conditions{DoesNotExist: true})
+	} else {
+		handle = handle.If(storageSDK.Conditions{GenerationMatch: generation})
+	}
+
+	writer := handle.NewWriter(ctx)
+	writer.ContentType = "application/json"
+	err := json.NewEncoder(writer).Encode(v)
+	if err != nil {
+		writer.Close()
+		return 0, err
+	}
+
+	// Preconditions are only evaluated once the upload completes
+	err = writer.Close()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return 0, ErrVersionConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+	return writer.Attrs().Generation, nil
 }
@@ -0,0 +1,185 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Number of top projects listed per reservation
+const teamsTopProjects = 3
+
+// Notifier posting an Adaptive Card to a Microsoft Teams incoming webhook or
+// Workflows URL
+type TeamsNotifier struct {
+	name      string
+	url       func() string
+	templates *Templates
+	policy    DeliveryPolicy
+}
+
+// Create a Teams notifier. The URL is resolved on every notification, so rotated
+// secrets are picked up without a restart.
+func NewTeamsNotifier(name string, url func() string, templates *Templates, policy DeliveryPolicy) *TeamsNotifier {
+	return &TeamsNotifier{name: name, url: url, templates: templates, policy: policy}
+}
+
+// Name of the notifier instance
+func (notifier *TeamsNotifier) Name() string {
+	return notifier.name
+}
+
+// Render the state into an Adaptive Card and post it to the webhook
+func (notifier *TeamsNotifier) Notify(ctx context.Context, state *State) Delivery {
+	// Skip if webhook URL is not configured
+	url := notifier.url()
+	if !webhookConfigured(url) {
+		log.Printf("webhook for %s not configured, skipping...\n", notifier.name)
+		delivery := NewDelivery(notifier.name, state, 0, nil)
+		delivery.Status = DeliverySkipped
+		return delivery
+	}
+	log.Printf("publishing card to %s\n", notifier.name)
+
+	attempts, err := postJSON(ctx, url, nil, cardMessage(state.AdaptiveCard()), notifier.policy)
+	return NewDelivery(notifier.name, state, attempts, err)
+}
+
+// Render the report and post it to the webhook as text of an Adaptive Card
+func (notifier *TeamsNotifier) NotifyReport(ctx context.Context, report Report) Delivery {
+	state := report.state()
+	url := notifier.url()
+	if !webhookConfigured(url) {
+		log.Printf("webhook for %s not configured, skipping...\n", notifier.name)
+		delivery := NewDelivery(notifier.name, state, 0, nil)
+		delivery.Status = DeliverySkipped
+		return delivery
+	}
+	log.Printf("publishing report to %s\n", notifier.name)
+
+	message, err := report.render(notifier.templates)
+	if err != nil {
+		return NewDelivery(notifier.name, state, 0, err)
+	}
+	card := map[string]interface{}{
+		"type":    "AdaptiveCard",
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"version": "1.4",
+		"body": []interface{}{
+			map[string]interface{}{"type": "TextBlock", "text": message, "wrap": true, "fontType": "Monospace"},
+		},
+	}
+	attempts, err := postJSON(ctx, url, nil, cardMessage(card), notifier.policy)
+	return NewDelivery(notifier.name, state, attempts, err)
+}
+
+// Wrap a card into a message, as accepted by both incoming webhooks and Workflows
+func cardMessage(card map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{
+			map[string]interface{}{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content":     card,
+			},
+		},
+	}
+}
+
+// Render the state into an Adaptive Card with a fact set per reservation
+func (state *State) AdaptiveCard() map[string]interface{} {
+	body := []interface{}{
+		map[string]interface{}{
+			"type":   "TextBlock",
+			"text":   "Reservation Report",
+			"size":   "Large",
+			"weight": "Bolder",
+		},
+	}
+
+	ids := make([]string, 0, len(state.Reservations))
+	for id := range state.Reservations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		reservation := state.Reservations[id]
+
+		// Highlight reservations breaching their threshold
+		color := "Warning"
+		if reservation.ThresholdBreached {
+			color = "Attention"
+		}
+		body = append(body, map[string]interface{}{
+			"type":      "TextBlock",
+			"text":      reservation.Title(),
+			"weight":    "Bolder",
+			"color":     color,
+			"separator": true,
+			"spacing":   "Medium",
+		})
+
+		// Summarize usage and the projects driving it
+		var projects []string
+		for _, project := range reservation.TopProjects(teamsTopProjects) {
+			projects = append(projects, fmt.Sprintf("%s (%.0f slots)", project.Project, project.Usage))
+		}
+		if len(projects) == 0 {
+			projects = []string{"-"}
+		}
+		facts := []interface{}{
+			fact("Slots", fmt.Sprintf("%d / %v", reservation.TotalUsageCeiling, reservation.Capacity())),
+			fact("Utilization", fmt.Sprintf("%s%%", reservation.Percentage)),
+		}
+		if reservation.HourlyCost > 0 {
+			facts = append(facts, fact("Est. cost", fmt.Sprintf("%s/h", formatCost(reservation.HourlyCost))))
+		}
+		facts = append(facts,
+			fact("Jobs", fmt.Sprintf("%d", reservation.NumJobs)),
+			fact("Top projects", strings.Join(projects, ", ")),
+		)
+		body = append(body, map[string]interface{}{
+			"type":  "FactSet",
+			"facts": facts,
+		})
+
+		// Add the reasons for alerts beyond the threshold
+		for _, note := range reservation.notes() {
+			body = append(body, map[string]interface{}{
+				"type": "TextBlock",
+				"text": note,
+				"wrap": true,
+				"size": "Small",
+			})
+		}
+	}
+
+	return map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+}
+
+// Single fact of an Adaptive Card fact set
+func fact(title string, value string) map[string]interface{} {
+	return map[string]interface{}{"title": title, "value": value}
+}
@@ -0,0 +1,40 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import "testing"
+
+func TestAdaptiveCardSlots(t *testing.T) {
+	tests := []struct {
+		name        string
+		reservation Reservation
+		slots       string
+	}{
+		{"baseline", Reservation{Slots: 500, AutoscaleMaxSlots: 100, TotalUsageCeiling: 250}, "250 / 500"},
+		{"autoscale only", Reservation{AutoscaleMaxSlots: 300, TotalUsageCeiling: 120}, "120 / 300"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.reservation.Name = "r1"
+			state := &State{Reservations: map[string]Reservation{"US.r1": test.reservation}}
+			body := state.AdaptiveCard()["body"].([]interface{})
+			facts := body[2].(map[string]interface{})["facts"].([]interface{})
+			slots := facts[0].(map[string]interface{})
+			if slots["title"] != "Slots" || slots["value"] != test.slots {
+				t.Errorf("expected slots %s, got %v", test.slots, slots)
+			}
+		})
+	}
+}
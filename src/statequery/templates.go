@@ -0,0 +1,333 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmlTemplate "html/template"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	storageSDK "cloud.google.com/go/storage"
+)
+
+// Kinds of messages rendered from templates
+const (
+	TemplateFiring      = "firing"
+	TemplateFiringHTML  = "firing_html"
+	TemplateResolved    = "resolved"
+	TemplateDigest      = "digest"
+	TemplateRightsizing = "rightsizing"
+)
+
+// Built-in templates, relative to the working directory
+var defaultTemplates = TemplateSources{
+	TemplateFiring:      "templates/message.template",
+	TemplateFiringHTML:  "templates/message.html.template",
+	TemplateResolved:    "templates/resolved.template",
+	TemplateDigest:      "templates/digest.template",
+	TemplateRightsizing: "templates/rightsizing.template",
+}
+
+// Sources of templates by kind. Each source is either a GCS object
+// (gs://bucket/object), the template itself if it contains '{{', or a file path,
+// e.g. of a secret volume mount.
+type TemplateSources map[string]string
+
+// Parsed templates by kind, ready for rendering
+type Templates struct {
+	text map[string]*template.Template
+	html map[string]*htmlTemplate.Template
+}
+
+// Helper functions available in all templates
+var templateFuncs = map[string]interface{}{
+	"percent":       percent,
+	"bar":           bar,
+	"duration":      humanizeDuration,
+	"cost":          formatCost,
+	"byUtilization": byUtilization,
+}
+
+// Reservation along with its ID, as ranked by 'byUtilization'
+type RankedReservation struct {
+	ID string
+	Reservation
+}
+
+// Load the built-in templates, overridden by the given sources in order. All
+// templates are parsed once and validated by rendering sample data, so mistakes
+// surface at startup rather than when alerting.
+func LoadTemplates(ctx context.Context, overrides ...TemplateSources) (*Templates, error) {
+	sources := TemplateSources{}
+	for _, layer := range append([]TemplateSources{defaultTemplates}, overrides...) {
+		for kind, source := range layer {
+			if source != "" {
+				sources[kind] = source
+			}
+		}
+	}
+
+	templates := &Templates{
+		text: make(map[string]*template.Template),
+		html: make(map[string]*htmlTemplate.Template),
+	}
+	for kind, source := range sources {
+		content, err := readTemplate(ctx, source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s template: %v", kind, err)
+		}
+
+		switch kind {
+		case TemplateFiring, TemplateResolved, TemplateDigest, TemplateRightsizing:
+			parsed, err := template.New(kind).Funcs(templateFuncs).Parse(content)
+			if err != nil {
+				return nil, err
+			}
+			templates.text[kind] = parsed
+		case TemplateFiringHTML:
+			parsed, err := htmlTemplate.New(kind).Funcs(templateFuncs).Parse(content)
+			if err != nil {
+				return nil, err
+			}
+			templates.html[kind] = parsed
+		default:
+			return nil, fmt.Errorf("unknown template kind: %s", kind)
+		}
+	}
+
+	err := templates.validate()
+	if err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+// Render the templates with sample data, to catch references to missing fields
+// and functions
+func (templates *Templates) validate() error {
+	samples := map[string]interface{}{
+		TemplateFiring:      sampleState(),
+		TemplateFiringHTML:  sampleState(),
+		TemplateResolved:    sampleTransition(),
+		TemplateDigest:      sampleDigest(),
+		TemplateRightsizing: sampleRightsizing(),
+	}
+	for kind, sample := range samples {
+		_, err := templates.Render(kind, sample)
+		if err != nil {
+			return fmt.Errorf("invalid %s template: %v", kind, err)
+		}
+	}
+	return nil
+}
+
+// Render the template of a kind with the given data. Surrounding whitespace is
+// trimmed, so templates may end with a newline.
+func (templates *Templates) Render(kind string, data interface{}) (string, error) {
+	var writer bytes.Buffer
+	if parsed, ok := templates.text[kind]; ok {
+		err := parsed.Execute(&writer, data)
+		if err != nil {
+			return "", err
+		}
+	} else if parsed, ok := templates.html[kind]; ok {
+		err := parsed.Execute(&writer, data)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		return "", fmt.Errorf("no %s template configured", kind)
+	}
+	return strings.TrimSpace(writer.String()), nil
+}
+
+// Render the alert message on the reservations of a state
+func (templates *Templates) Firing(state *State) (string, error) {
+	return templates.Render(TemplateFiring, state)
+}
+
+// Render the alert message on the reservations of a state as HTML
+func (templates *Templates) FiringHTML(state *State) (string, error) {
+	return templates.Render(TemplateFiringHTML, state)
+}
+
+// Render the message on a resolved incident
+func (templates *Templates) Resolved(transition Transition) (string, error) {
+	return templates.Render(TemplateResolved, transition)
+}
+
+// Render the digest of a period
+func (templates *Templates) Digest(digest *Digest) (string, error) {
+	return templates.Render(TemplateDigest, digest)
+}
+
+// Render the right-sizing recommendations
+func (templates *Templates) Rightsizing(rightsizing *Rightsizing) (string, error) {
+	return templates.Render(TemplateRightsizing, rightsizing)
+}
+
+// Read a template from GCS, a file or the source itself
+func readTemplate(ctx context.Context, source string) (string, error) {
+	if strings.Contains(source, "{{") {
+		return source, nil
+	}
+
+	if strings.HasPrefix(source, "gs://") {
+		tokens := strings.SplitN(strings.TrimPrefix(source, "gs://"), "/", 2)
+		if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+			return "", fmt.Errorf("invalid GCS template URI: %s", source)
+		}
+		client, err := storageSDK.NewClient(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer client.Close()
+
+		reader, err := client.Bucket(tokens[0]).Object(tokens[1]).NewReader(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Format a fraction as percentage, e.g. '85%' for 0.853
+func percent(fraction float64) string {
+	return fmt.Sprintf("%.0f%%", fraction*100)
+}
+
+// Render a fraction as bar chart of the given width, e.g. '██████░░░░' for 0.6
+func bar(fraction float64, width int) string {
+	filled := int(math.Round(math.Max(0, math.Min(1, fraction)) * float64(width)))
+	return strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+}
+
+// Format a duration in its two most significant units, e.g. '2d 3h' or '1h 20m'
+func humanizeDuration(duration time.Duration) string {
+	if duration < time.Minute {
+		return fmt.Sprintf("%ds", int(duration.Round(time.Second).Seconds()))
+	}
+	minutes := int(duration.Round(time.Minute).Minutes())
+	days, hours, minutes := minutes/(24*60), minutes/60%24, minutes%60
+	switch {
+	case days > 0 && hours > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case days > 0:
+		return fmt.Sprintf("%dd", days)
+	case hours > 0 && minutes > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh", hours)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
+
+// Format an amount in USD, e.g. '$1,234.50' or '-$42.00'
+func formatCost(amount float64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+	}
+	cents := int64(math.Round(math.Abs(amount) * 100))
+	digits := strconv.FormatInt(cents/100, 10)
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
+	}
+	return fmt.Sprintf("%s$%s.%02d", sign, digits, cents%100)
+}
+
+// Sort reservations by utilization, highest first
+func byUtilization(reservations map[string]Reservation) []RankedReservation {
+	ranked := make([]RankedReservation, 0, len(reservations))
+	for id, reservation := range reservations {
+		ranked = append(ranked, RankedReservation{ID: id, Reservation: reservation})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].UtilizationFactor() != ranked[j].UtilizationFactor() {
+			return ranked[i].UtilizationFactor() > ranked[j].UtilizationFactor()
+		}
+		return ranked[i].ID < ranked[j].ID
+	})
+	return ranked
+}
+
+// State exercising all optional parts of the alert templates
+func sampleState() *State {
+	now := time.Now().UTC()
+	saturation := now.Add(time.Hour)
+	job := Job{Name: "job_1", ID: "job_1", Project: "project", Location: "US", User: "user@example.com", Usage: 900}
+	return &State{
+		Timestamp: now,
+		Reservations: map[string]Reservation{
+			"US.sample": {
+				Name:                 "sample",
+				Location:             "US",
+				Slots:                1000,
+				Edition:              "ENTERPRISE",
+				HourlyCost:           60,
+				Projects:             []string{"project"},
+				Jobs:                 []Job{job},
+				NumJobs:              1,
+				TotalUsage:           900,
+				TotalUsageCeiling:    900,
+				Utilization:          0.9,
+				ThresholdBreached:    true,
+				Percentage:           "90",
+				AdditionalSlots:      125,
+				AdditionalHourlyCost: 7.5,
+				Forecast:             &Forecast{SaturationAt: &saturation, AdditionalSlots: 100, EarlyWarning: true, AdditionalHourlyCost: 6},
+				Anomaly:              &Anomaly{Score: 3, Detected: true},
+				RunawayJobs:          []RunawayJob{{Job: job, Reasons: []string{"runtime"}, Action: "cancelled"}},
+				AlertingSince:        &now,
+			},
+		},
+	}
+}
+
+// Transition of a resolved incident
+func sampleTransition() Transition {
+	now := time.Now().UTC()
+	return Transition{
+		Reservation: "US.sample",
+		Name:        "sample",
+		Location:    "US",
+		Status:      TransitionResolved,
+		Previous:    "critical",
+		Utilization: 0.5,
+		Since:       now.Add(-time.Hour),
+		Timestamp:   now,
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"log"
+)
+
+// Thread holding all messages of a notifier on one incident
+type Thread struct {
+	// Slack channel ID or Google Chat space
+	Channel string `json:"channel"`
+	// Slack timestamp or Google Chat name of the thread
+	Thread string `json:"thread"`
+	// Slack timestamp or Google Chat name of the first message, which is updated
+	// once the incident resolves
+	Message string `json:"message"`
+}
+
+// Notifiers keeping a thread per incident. They post updates on an incident as
+// replies to its thread, reported in the Threads of their deliveries, and are
+// informed of resolved incidents they posted to.
+type ThreadedNotifier interface {
+	Notifier
+	Resolve(ctx context.Context, transitions []Transition) Delivery
+}
+
+// State holding the reservations of resolved incidents, to report deliveries on them
+func resolvedState(transitions []Transition) *State {
+	state := &State{Reservations: make(map[string]Reservation), Transitions: transitions}
+	for _, transition := range transitions {
+		state.Timestamp = transition.Timestamp
+		state.Reservations[transition.Reservation] = Reservation{Name: transition.Name, Location: transition.Location}
+	}
+	return state
+}
+
+// Post a message per reservation of the state, rendered from the firing template
+// of the reservation alone. Post is given the known thread of the incident, if
+// any, and returns the thread the message was posted to. Failures do not stop the
+// remaining reservations, but the first one is reported. Threads started by the
+// posts are reported in the delivery, unless post returns none, e.g. for threads
+// derived from the incident.
+func notifyThreads(ctx context.Context, name string, templates *Templates, state *State,
+	post func(ctx context.Context, id string, single *State, message string, thread Thread, threaded bool) (Thread, int, error)) Delivery {
+	attempts := 0
+	threads := make(map[string]Thread)
+	var failure error
+	for _, id := range sortedIDs(state) {
+		reservation := state.Reservations[id]
+		single := &State{
+			Timestamp:    state.Timestamp,
+			Reservations: map[string]Reservation{id: reservation},
+		}
+
+		message, err := templates.Firing(single)
+		if err != nil {
+			return NewDelivery(name, state, attempts, err)
+		}
+		thread, threaded := reservation.Threads[name]
+		posted, tries, err := post(ctx, id, single, message, thread, threaded)
+		if tries > attempts {
+			attempts = tries
+		}
+		if err != nil {
+			log.Printf("failed to post %s to %s: %v\n", id, name, err)
+			if failure == nil {
+				failure = err
+			}
+			continue
+		}
+		if !threaded && posted != (Thread{}) {
+			threads[id] = posted
+		}
+	}
+
+	delivery := NewDelivery(name, state, attempts, failure)
+	delivery.Threads = threads
+	return delivery
+}
+
+// Update the first message of resolved incidents and reply the resolution to
+// their threads, both rendered from the resolved template. The reply is posted
+// even if the update failed, so the thread always tells the incident is over.
+func resolveThreads(ctx context.Context, name string, templates *Templates, transitions []Transition,
+	update func(ctx context.Context, thread Thread, text string) (int, error),
+	reply func(ctx context.Context, thread Thread, text string) (int, error)) Delivery {
+	log.Printf("resolving %d threads of %s\n", len(transitions), name)
+
+	attempts := 0
+	var failure error
+	track := func(transition Transition, tries int, err error) {
+		if tries > attempts {
+			attempts = tries
+		}
+		if err != nil {
+			log.Printf("failed to resolve %s on %s: %v\n", transition.Reservation, name, err)
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+	for _, transition := range transitions {
+		thread := transition.Threads[name]
+		text, err := templates.Resolved(transition)
+		if err != nil {
+			return NewDelivery(name, resolvedState(transitions), attempts, err)
+		}
+
+		tries, err := update(ctx, thread, text)
+		track(transition, tries, err)
+		tries, err = reply(ctx, thread, text)
+		track(transition, tries, err)
+	}
+	return NewDelivery(name, resolvedState(transitions), attempts, failure)
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statequery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Post of a reservation as seen by notifyThreads
+type threadPost struct {
+	id       string
+	thread   Thread
+	threaded bool
+}
+
+// Post function recording posts and starting a thread per reservation, failing
+// for the given reservations
+func recordPosts(posts *[]threadPost, failing ...string) func(context.Context, string, *State, string, Thread, bool) (Thread, int, error) {
+	return func(ctx context.Context, id string, single *State, message string, thread Thread, threaded bool) (Thread, int, error) {
+		*posts = append(*posts, threadPost{id: id, thread: thread, threaded: threaded})
+		for _, failed := range failing {
+			if id == failed {
+				return Thread{}, 3, errors.New("post failed")
+			}
+		}
+		return Thread{Channel: "spaces/s", Thread: "spaces/s/threads/" + id, Message: "spaces/s/messages/" + id}, 1, nil
+	}
+}
+
+func TestNotifyThreads(t *testing.T) {
+	state := &State{Reservations: map[string]Reservation{
+		"US.r1": {Name: "r1", ThresholdBreached: true, Threads: map[string]Thread{"chat": {Thread: "spaces/s/threads/old"}}},
+		"US.r2": {Name: "r2", ThresholdBreached: true},
+		"US.r3": {Name: "r3", ThresholdBreached: true},
+	}}
+
+	var posts []threadPost
+	delivery := notifyThreads(context.Background(), "chat", testTemplates(t), state, recordPosts(&posts, "US.r2"))
+
+	if len(posts) != 3 {
+		t.Fatalf("expected a post per reservation, got %+v", posts)
+	}
+	if !posts[0].threaded || posts[0].thread.Thread != "spaces/s/threads/old" {
+		t.Errorf("expected reply to the known thread, got %+v", posts[0])
+	}
+	if posts[2].threaded {
+		t.Errorf("expected a new thread, got %+v", posts[2])
+	}
+	if delivery.Status != DeliveryFailed || delivery.Attempts != 3 {
+		t.Errorf("expected failed delivery after 3 attempts, got %+v", delivery)
+	}
+	if len(delivery.Threads) != 1 || delivery.Threads["US.r3"].Thread != "spaces/s/threads/US.r3" {
+		t.Errorf("expected only the new thread of US.r3, got %+v", delivery.Threads)
+	}
+}
+
+func TestResolveThreadsRepliesAfterFailedUpdate(t *testing.T) {
+	transitions := []Transition{
+		{Reservation: "US.r1", Name: "r1", Status: TransitionResolved, Threads: map[string]Thread{"chat": {Thread: "t1", Message: "m1"}}},
+		{Reservation: "US.r2", Name: "r2", Status: TransitionResolved, Threads: map[string]Thread{"chat": {Thread: "t2", Message: "m2"}}},
+	}
+
+	var updated, replied []string
+	update := func(ctx context.Context, thread Thread, text string) (int, error) {
+		updated = append(updated, thread.Message)
+		if thread.Message == "m1" {
+			return 2, errors.New("update failed")
+		}
+		return 1, nil
+	}
+	reply := func(ctx context.Context, thread Thread, text string) (int, error) {
+		replied = append(replied, thread.Thread)
+		return 1, nil
+	}
+	delivery := resolveThreads(context.Background(), "chat", testTemplates(t), transitions, update, reply)
+
+	if len(updated) != 2 {
+		t.Errorf("expected both messages updated, got %v", updated)
+	}
+	if len(replied) != 2 || replied[0] != "t1" || replied[1] != "t2" {
+		t.Errorf("expected replies to both threads, got %v", replied)
+	}
+	if delivery.Status != DeliveryFailed || delivery.Attempts != 2 {
+		t.Errorf("expected failed delivery after 2 attempts, got %+v", delivery)
+	}
+}
+
+func TestSilencedIncidentKeepsThread(t *testing.T) {
+	ctx := context.Background()
+	store, _ := NewIncidentStore(ctx, "")
+	track(t, store, trackedState(0, true, false))
+	thread := Thread{Channel: "spaces/s", Thread: "spaces/s/threads/US.r1", Message: "spaces/s/messages/US.r1"}
+	err := store.SaveThreads(ctx, "chat", map[string]Thread{"US.r1": thread})
+	if err != nil {
+		t.Fatalf("SaveThreads() failed: %v", err)
+	}
+
+	// Silencing the breach resolves nothing, so the thread is not touched
+	transitions := track(t, store, trackedState(1, true, true))
+	for _, transition := range transitions {
+		if transition.Status == TransitionResolved {
+			t.Fatalf("expected no resolution of the silenced incident, got %+v", transition)
+		}
+	}
+
+	// Once the silence ends, updates are replied to the same thread
+	state := trackedState(2, true, false)
+	track(t, store, state)
+	var posts []threadPost
+	delivery := notifyThreads(ctx, "chat", testTemplates(t), state, recordPosts(&posts))
+	if len(posts) != 1 || !posts[0].threaded || posts[0].thread != thread {
+		t.Errorf("expected reply to the thread of the incident, got %+v", posts)
+	}
+	if len(delivery.Threads) != 0 {
+		t.Errorf("expected no new threads, got %+v", delivery.Threads)
+	}
+}
+
+func TestWebhookThreadsByIncident(t *testing.T) {
+	var mutex sync.Mutex
+	keys := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := struct {
+			Thread struct {
+				ThreadKey string `json:"threadKey"`
+			} `json:"thread"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		mutex.Lock()
+		keys[payload.Thread.ThreadKey] = r.URL.RawQuery
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	since := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	state := &State{Reservations: map[string]Reservation{
+		"US.r1": {Name: "r1", ThresholdBreached: true, AlertingSince: &since},
+		"US.r2": {Name: "r2", ThresholdBreached: true, AlertingSince: &since},
+	}}
+	notifier := NewWebhookNotifier("gchat", func() string { return server.URL + "?key=k" }, testTemplates(t), DeliveryPolicy{})
+	notifier.Threaded = true
+	delivery := notifier.Notify(context.Background(), state)
+
+	if delivery.Status != DeliveryDelivered || len(delivery.Threads) != 0 {
+		t.Errorf("expected delivery without recorded threads, got %+v", delivery)
+	}
+	for _, id := range []string{"US.r1", "US.r2"} {
+		key := ThreadKey(id, state.Reservations[id])
+		query, ok := keys[key]
+		if !ok {
+			t.Errorf("expected a post with thread key %s, got %v", key, keys)
+			continue
+		}
+		if query != "key=k&messageReplyOption=REPLY_MESSAGE_FALLBACK_TO_NEW_THREAD" {
+			t.Errorf("unexpected query of %s: %s", key, query)
+		}
+	}
+}
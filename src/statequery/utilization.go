@@ -17,8 +17,16 @@ package statequery
 import (
 	"fmt"
 	"math"
+	"sort"
+	"strings"
 )
 
+// Slot usage of a single project within a reservation
+type ProjectUsage struct {
+	Project string  `json:"project"`
+	Usage   float64 `json:"usage"`
+}
+
 // Compute total utilization statistics per reservation and add them to the state
 func (state *State) ComputeUtilization(threshold float64) {
 	for id, reservation := range state.Reservations {
@@ -31,12 +39,18 @@ func (state *State) ComputeUtilization(threshold float64) {
 			reservation.TotalUsage += job.Usage
 		}
 
-		// Utilization factor
-		utilization := reservation.TotalUsage / reservation.Slots
+		// Utilization factor, guarding against reservations without any capacity
+		utilization := 0.0
+		if capacity := reservation.Capacity(); capacity > 0 {
+			utilization = reservation.TotalUsage / capacity
+		}
+		reservation.Utilization = utilization
 
-		// Set breach flag if utilization crosses threshold
+		// Set breach flag if utilization crosses threshold, and recommend the slots
+		// bringing it back below
 		if utilization >= threshold {
 			reservation.ThresholdBreached = true
+			reservation.recommendSlots(threshold)
 		}
 
 		// Round slot usage up to natural ceiling
@@ -47,3 +61,109 @@ func (state *State) ComputeUtilization(threshold float64) {
 		state.Reservations[id] = reservation
 	}
 }
+
+// Recommend the slots bringing the utilization of a reservation back below the
+// given one, or none if it is not positive. Costs are estimated separately, so any
+// previous estimate is cleared.
+func (reservation *Reservation) recommendSlots(limit float64) {
+	reservation.AdditionalSlots = 0
+	reservation.AdditionalHourlyCost = 0
+	if limit <= 0 {
+		return
+	}
+	needed := reservation.TotalUsage/limit - reservation.Capacity()
+	if needed > 0 {
+		reservation.AdditionalSlots = int(math.Ceil(needed))
+	}
+}
+
+// Get the utilization factor of a reservation. Falls back to computing it for states
+// archived before the factor was recorded.
+func (reservation Reservation) UtilizationFactor() float64 {
+	if reservation.Utilization != 0 || reservation.Capacity() == 0 {
+		return reservation.Utilization
+	}
+	return reservation.TotalUsage / reservation.Capacity()
+}
+
+// Slots utilization is measured against: the baseline, or the autoscale maximum
+// for reservations running on autoscaled slots only
+func (reservation Reservation) Capacity() float64 {
+	if reservation.Slots > 0 {
+		return reservation.Slots
+	}
+	return reservation.AutoscaleMaxSlots
+}
+
+// Whether a reservation requires an alert, either because it is breaching its
+// threshold, is projected to do so soon or runs runaway jobs, and is not suppressed
+// by a silence or maintenance window
+func (reservation Reservation) Alerting() bool {
+	return !reservation.Suppressed && reservation.Severity() != ""
+}
+
+// Get the projects using the most slots of a reservation, at most n of them
+func (reservation Reservation) TopProjects(n int) []ProjectUsage {
+	usage := make(map[string]float64)
+	for _, job := range reservation.Jobs {
+		// Jobs archived before projects were recorded carry them in their name
+		project := job.Project
+		if project == "" {
+			project = strings.SplitN(job.Name, ":", 2)[0]
+		}
+		usage[project] += job.Usage
+	}
+
+	projects := make([]ProjectUsage, 0, len(usage))
+	for project, slots := range usage {
+		projects = append(projects, ProjectUsage{Project: project, Usage: slots})
+	}
+	sort.Slice(projects, func(i, j int) bool {
+		if projects[i].Usage != projects[j].Usage {
+			return projects[i].Usage > projects[j].Usage
+		}
+		return projects[i].Project < projects[j].Project
+	})
+	if len(projects) > n {
+		projects = projects[:n]
+	}
+	return projects
+}
+
+// Incremental cost of recommended slots, if prices are known
+func additionalCost(hourlyCost float64) string {
+	if hourlyCost <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (+%s/h)", formatCost(hourlyCost))
+}
+
+// Human readable notes on anomalies, forecasts and runaway jobs of a reservation,
+// matching the lines of the text message
+func (reservation Reservation) notes() []string {
+	var notes []string
+	if reservation.Anomaly != nil && reservation.Anomaly.Detected {
+		notes = append(notes, fmt.Sprintf("Unusual for this time of week: %.1f standard deviations above baseline", reservation.Anomaly.Score))
+	}
+	if reservation.AdditionalSlots > 0 {
+		notes = append(notes, fmt.Sprintf("%d additional slots needed to return below threshold%s",
+			reservation.AdditionalSlots, additionalCost(reservation.AdditionalHourlyCost)))
+	}
+	if forecast := reservation.Forecast; forecast != nil {
+		cost := additionalCost(forecast.AdditionalHourlyCost)
+		if forecast.EarlyWarning && forecast.SaturationAt != nil {
+			notes = append(notes, fmt.Sprintf("Projected to cross threshold at %s, %d additional slots needed%s",
+				forecast.SaturationAt.Format("2006-01-02 15:04 MST"), forecast.AdditionalSlots, cost))
+		} else if forecast.AdditionalSlots > 0 {
+			notes = append(notes, fmt.Sprintf("%d additional slots recommended%s", forecast.AdditionalSlots, cost))
+		}
+	}
+	for _, job := range reservation.RunawayJobs {
+		note := fmt.Sprintf("Runaway job %s by %s: %s", job.Name, job.User, strings.Join(job.Reasons, ", "))
+		if job.Action != RunawayActionNone {
+			note = fmt.Sprintf("%s (%s)", note, job.Action)
+		}
+		notes = append(notes, note)
+	}
+	return notes
+}
@@ -15,11 +15,19 @@
 
 # Configuration to customize
 locals {
-  prefix         = "bq-utilization-alerts"
-  region         = "europe-west1"
-  project        = "<PROJECT_ID>"
-  project_number = "<PROJECT_NUMBER>"
-  schedule       = "*/5 * * * *" # Every 5 minutes
+  prefix               = "bq-utilization-alerts"
+  region               = "europe-west1"
+  project              = "<PROJECT_ID>"
+  project_number       = "<PROJECT_NUMBER>"
+  schedule             = "*/5 * * * *" # Every 5 minutes
+  digest_schedule      = "0 8 * * 1"   # Mondays at 08:00 UTC
+  digest_period        = "weekly"      # 'daily' or 'weekly'
+  chargeback_schedule  = "30 0 * * *"  # Daily at 00:30 UTC, for the previous day
+  rightsizing_schedule = "0 9 * * 1"   # Mondays at 09:00 UTC
+  teams_enabled        = false         # Post to the webhook of the teams secret
+  admin_projects = toset([
+  ]) # Add reservation admin project IDs, if other than the project above
+  namespace_reservations = false # Required with more than one admin project, changes reservation IDs
   scan_projects = toset([
   ]) # Add project IDs
   scan_organizations = toset([
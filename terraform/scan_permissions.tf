@@ -13,6 +13,14 @@
 # limitations under the License.
 
 
+# Grant service SA permissions to read reservations in further admin projects
+resource "google_project_iam_member" "admin_bigquery" {
+  for_each = local.admin_projects
+  project  = each.key
+  role     = "roles/bigquery.resourceViewer"
+  member   = "serviceAccount:${google_service_account.service.email}"
+}
+
 # Grant service SA permissions to query BigQuery in projects
 resource "google_project_iam_member" "scan_bigquery" {
   for_each = local.scan_projects
@@ -40,6 +40,19 @@ resource "google_secret_manager_secret" "secret_gchat_hook" {
   ]
 }
 
+resource "google_secret_manager_secret" "secret_teams_hook" {
+  project  = local.project
+  provider = google-beta
+
+  secret_id = "${local.prefix}-secret-teams-hook"
+  replication {
+    automatic = true
+  }
+  depends_on = [
+    google_project_service.secretmanager
+  ]
+}
+
 resource "google_secret_manager_secret_version" "secret_slack_hook_data" {
   provider = google-beta
 
@@ -60,6 +73,16 @@ resource "google_secret_manager_secret_version" "secret_gchat_hook_data" {
   ]
 }
 
+resource "google_secret_manager_secret_version" "secret_teams_hook_data" {
+  provider = google-beta
+
+  secret      = google_secret_manager_secret.secret_teams_hook.name
+  secret_data = "invalid"
+  depends_on = [
+    google_project_service.secretmanager
+  ]
+}
+
 resource "google_secret_manager_secret_iam_member" "secret_slack_hook_access" {
   project  = local.project
   provider = google-beta
@@ -80,6 +103,16 @@ resource "google_secret_manager_secret_iam_member" "secret_gchat_hook_access" {
   depends_on = [google_secret_manager_secret.secret_gchat_hook]
 }
 
+resource "google_secret_manager_secret_iam_member" "secret_teams_hook_access" {
+  project  = local.project
+  provider = google-beta
+
+  secret_id  = google_secret_manager_secret.secret_teams_hook.id
+  role       = "roles/secretmanager.secretAccessor"
+  member     = "serviceAccount:${google_service_account.service.email}"
+  depends_on = [google_secret_manager_secret.secret_teams_hook]
+}
+
 output "slack_secret" {
   value = google_secret_manager_secret.secret_slack_hook.name
 }
@@ -87,3 +120,7 @@ output "slack_secret" {
 output "gchat_secret" {
   value = google_secret_manager_secret.secret_gchat_hook.name
 }
+
+output "teams_secret" {
+  value = google_secret_manager_secret.secret_teams_hook.name
+}
@@ -50,6 +50,13 @@ resource "google_cloud_run_service" "service" {
   name     = "${local.prefix}-service"
   location = local.region
   template {
+    metadata {
+      annotations = {
+        # Keep CPU allocated after responding, as Slack actions and commands are
+        # performed in the background once acknowledged
+        "run.googleapis.com/cpu-throttling" = "false"
+      }
+    }
     spec {
       service_account_name = google_service_account.service.email
       containers {
@@ -62,10 +69,29 @@ resource "google_cloud_run_service" "service" {
           name       = "gchat"
           mount_path = "/gchat"
         }
+        volume_mounts {
+          name       = "teams"
+          mount_path = "/teams"
+        }
         env {
           name  = "GOOGLE_CLOUD_PROJECT"
           value = local.project
         }
+        env {
+          name  = "ADMIN_PROJECTS"
+          value = join(",", length(local.admin_projects) > 0 ? tolist(local.admin_projects) : [local.project])
+        }
+        env {
+          name  = "NAMESPACE_RESERVATIONS"
+          value = tostring(local.namespace_reservations)
+        }
+        dynamic "env" {
+          for_each = local.teams_enabled ? [1] : []
+          content {
+            name  = "NOTIFIERS"
+            value = jsonencode([{ name = "teams", type = "teams", webhook_file = "/teams/webhook" }])
+          }
+        }
         env {
           name  = "SLOT_USAGE_THRESHOLD"
           value = "0.8"
@@ -101,6 +127,16 @@ resource "google_cloud_run_service" "service" {
           }
         }
       }
+      volumes {
+        name = "teams"
+        secret {
+          secret_name = google_secret_manager_secret.secret_teams_hook.secret_id
+          items {
+            key  = "latest"
+            path = "webhook"
+          }
+        }
+      }
     }
   }
   metadata {
@@ -116,8 +152,10 @@ resource "google_cloud_run_service" "service" {
   depends_on = [
     google_secret_manager_secret_version.secret_slack_hook_data,
     google_secret_manager_secret_version.secret_gchat_hook_data,
+    google_secret_manager_secret_version.secret_teams_hook_data,
     google_secret_manager_secret_iam_member.secret_slack_hook_access,
     google_secret_manager_secret_iam_member.secret_gchat_hook_access,
+    google_secret_manager_secret_iam_member.secret_teams_hook_access,
   ]
 }
 
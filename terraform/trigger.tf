@@ -44,10 +44,83 @@ resource "google_cloud_scheduler_job" "local_trigger" {
 
   http_target {
     http_method = "POST"
-    uri         = google_cloud_run_service.service.status[0].url
+    uri         = "${google_cloud_run_service.service.status[0].url}/scan"
 
     oidc_token {
       service_account_email = google_service_account.local_trigger.email
+      audience              = google_cloud_run_service.service.status[0].url
+    }
+  }
+
+  depends_on = [
+    google_app_engine_application.default
+  ]
+}
+
+# Cloud Scheduler trigger for digest reports
+resource "google_cloud_scheduler_job" "digest_trigger" {
+  name             = "${local.prefix}-digest-scheduler"
+  description      = "${local.prefix}-digest-scheduler"
+  project          = local.project
+  schedule         = local.digest_schedule
+  time_zone        = "UTC"
+  attempt_deadline = "300s"
+
+  http_target {
+    http_method = "POST"
+    uri         = "${google_cloud_run_service.service.status[0].url}/digest?period=${local.digest_period}"
+
+    oidc_token {
+      service_account_email = google_service_account.local_trigger.email
+      audience              = google_cloud_run_service.service.status[0].url
+    }
+  }
+
+  depends_on = [
+    google_app_engine_application.default
+  ]
+}
+
+# Cloud Scheduler trigger for chargeback reports of the previous day
+resource "google_cloud_scheduler_job" "chargeback_trigger" {
+  name             = "${local.prefix}-chargeback-scheduler"
+  description      = "${local.prefix}-chargeback-scheduler"
+  project          = local.project
+  schedule         = local.chargeback_schedule
+  time_zone        = "UTC"
+  attempt_deadline = "300s"
+
+  http_target {
+    http_method = "POST"
+    uri         = "${google_cloud_run_service.service.status[0].url}/chargeback"
+
+    oidc_token {
+      service_account_email = google_service_account.local_trigger.email
+      audience              = google_cloud_run_service.service.status[0].url
+    }
+  }
+
+  depends_on = [
+    google_app_engine_application.default
+  ]
+}
+
+# Cloud Scheduler trigger for right-sizing recommendations
+resource "google_cloud_scheduler_job" "rightsizing_trigger" {
+  name             = "${local.prefix}-rightsizing-scheduler"
+  description      = "${local.prefix}-rightsizing-scheduler"
+  project          = local.project
+  schedule         = local.rightsizing_schedule
+  time_zone        = "UTC"
+  attempt_deadline = "300s"
+
+  http_target {
+    http_method = "POST"
+    uri         = "${google_cloud_run_service.service.status[0].url}/rightsizing"
+
+    oidc_token {
+      service_account_email = google_service_account.local_trigger.email
+      audience              = google_cloud_run_service.service.status[0].url
     }
   }
 